@@ -1,47 +1,210 @@
 package main
 
 import (
+    "bufio"
     "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "compress/zlib"
     "context"
+    "crypto/tls"
+    "crypto/x509"
     "encoding/json"
     "errors"
     "fmt"
     "io"
-    "log"
+    "log/slog"
+    "math"
+    "math/rand"
+    "mime/multipart"
     "net"
     "net/http"
+    "net/http/httptrace"
     "net/url"
     "os"
+    "os/signal"
+    "path/filepath"
     "regexp"
+    "runtime"
+    "slices"
+    "sort"
+    "strconv"
     "strings"
     "sync"
+    "sync/atomic"
+    "syscall"
+    "text/template"
     "time"
+    _ "time/tzdata"
+    "unicode"
 )
 
 const (
-    defaultBackend    = "api.asailor.org"
-    maxBackends       = 20
-    maxConcurrency    = 5
-    requestTimeout    = 10 * time.Second
-    pollTimeout       = 30 * time.Second
-    backendBodyLimit  = 128 * 1024
-    updatesBodyLimit  = 1 * 1024 * 1024
+    defaultBackend     = "api.asailor.org"
+    defaultMaxBackends = 20
+    defaultConcurrency = 5
+    defaultTimeout     = 10 * time.Second
+    telegramTimeout    = 10 * time.Second
+    defaultPollTimeout = 30 * time.Second
+    maxPollTimeout     = 50
+    backendBodyLimit   = 128 * 1024
+    updatesBodyLimit   = 1 * 1024 * 1024
+    defaultCacheTTL    = 15 * time.Second
+    defaultWorkers     = 3
+    maxWorkers         = 32
+    updateQueueSize    = 100
+    defaultJitterRuns  = 5
+    maxJitterRuns      = 20
+    jitterSpacing      = 300 * time.Millisecond
+    shutdownTimeout    = 15 * time.Second
+    defaultOffsetFile  = "./offset.state"
+    defaultWatchdog    = 2 * time.Minute
+    clockSkewWarn      = 30 * time.Second
+    defaultRetries     = 1
+    retryBaseDelay     = 500 * time.Millisecond
+    convertTimeout     = 30 * time.Second
+    convertBodyLimit   = 4 * 1024 * 1024
+    defaultSendRPS     = 30
+    defaultChatPerMin  = 20
+    limiterIdleChats   = 1024
+    defaultCertWarn    = 14
+    messageLimit       = 4096
+    markdownV2         = "MarkdownV2"
+    defaultSnapshots   = 100
+    snapshotPrefix     = "snapshot-"
+    statusDocument     = "backend-status.json"
+    textDocument       = "backend-status.txt"
+    probeJitterMax     = 200 * time.Millisecond
+    statsFlushInterval = time.Minute
+    defaultRefreshWait = 10 * time.Second
+    sendRetries        = 2
+    sendRetryMaxWait   = 30 * time.Second
+    defaultUserAgent   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"
+    defaultDNSCacheTTL = 30 * time.Second
+    dnsCacheSize       = 256
+    defaultAccept      = "text/plain,text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+    typingInterval     = 4 * time.Second
+    defaultLang        = "zh"
+    defaultHealthPath  = "/version"
+    defaultTelegramAPI = "https://api.telegram.org"
+    pollBackoffBase    = time.Second
+    pollBackoffMax     = 60 * time.Second
+    conflictBackoff    = 30 * time.Second
+    startupRetries     = 5
+    defaultCooldown    = 5 * time.Minute
+    defaultLatencyWarn = 300 * time.Millisecond
+    defaultLatencyBad  = 1000 * time.Millisecond
+    defaultRedirects   = 3
 )
 
+// Build information, set at build time with
+// -ldflags "-X main.botVersion=... -X main.botCommit=... -X main.botBuildDate=...".
 var (
-    versionPattern = regexp.MustCompile(`^subconverter\s+v[\d.]+-[\w]+ backend$`)
+    botVersion   = "dev"
+    botCommit    = "unknown"
+    botBuildDate = "unknown"
+)
+
+var errTelegramNotOK = errors.New("telegram api returned ok=false")
+
+// errBlockedTarget marks requests refused by the private-target guard.
+var errBlockedTarget = errors.New("target not allowed")
+
+var (
+    versionPattern = regexp.MustCompile(`^subconverter\s+(v[\d.]+-[\w]+) backend$`)
     extendedMarker = regexp.MustCompile(`(?i)SubConverter-Extended`)
     infoCardPattern = regexp.MustCompile(
         `(?is)<span class="info-label">\s*(Version|Build|Build Date)\s*</span>\s*<div class="info-value">(.*?)</div>`,
     )
-    tagPattern        = regexp.MustCompile(`(?s)<[^>]+>`)
-    whitespacePattern = regexp.MustCompile(`\s+`)
-    schemePattern     = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+    tagPattern          = regexp.MustCompile(`(?s)<[^>]+>`)
+    whitespacePattern   = regexp.MustCompile(`\s+`)
+    schemePattern       = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+    targetOptionPattern = regexp.MustCompile(`@([a-z_]+)=([^@]*)$`)
+    markdownEscaper     = newMarkdownEscaper()
+    markdownCodeEscaper = strings.NewReplacer("\\", "\\\\", "`", "\\`")
+    htmlTitlePattern    = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+    subWebPattern       = regexp.MustCompile(`(?i)sub-web|subscription\s*convert|订阅转换`)
+    clashProxiesPattern = regexp.MustCompile(`(?m)^(proxies|proxy-providers):\s*$`)
+    hostnamePattern     = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+)
+
+var (
+    statusCacheTTL      = defaultCacheTTL
+    resultsCache        = &statusCache{}
+    checkFlights        = &checkGroup{calls: make(map[string]*checkCall)}
+    processCtx          = context.Background()
+    redactPatterns      []*regexp.Regexp
+    minOnlinePercent    float64
+    allowPrivateTargets bool
+    diagMode            bool
+    traceTimings        bool
+    sortMode            string
+    alertNotifiers      []notifier
+    maxBackends         = defaultMaxBackends
+    maxConcurrency      = defaultConcurrency
+    requestTimeout      = defaultTimeout
+    backendRetries      = defaultRetries
+    deepProbeURL        string
+    outboundLimiter     = newSendLimiter(defaultSendRPS, defaultChatPerMin)
+    certWarnDays        = defaultCertWarn
+    botMetrics          = newMetrics()
+    adminIDs            = map[int64]struct{}{}
+    pollInterval        time.Duration
+    sendTokens          *tokenRotator
+    transitions         = newAlertTracker(1)
+    allowedUpdates      = []string{"message", "edited_message", "my_chat_member", "callback_query"}
+    welcomeEnabled      bool
+    replyToMessage      bool
+    insecureSkipAll     bool
+    insecureHosts       = map[string]struct{}{}
+    activeTargets       atomic.Pointer[targetSet]
+    pollReady           atomic.Bool
+    breakers            = newCircuitBreaker(0, defaultCooldown)
+    probeMethod         = http.MethodGet
+    expectContains      string
+    maintenancePattern  *regexp.Regexp
+    latencyWarn         = defaultLatencyWarn
+    latencyBad          = defaultLatencyBad
+    dualStackProbe      bool
+    pollTimeout         = defaultPollTimeout
+    channelPosts        bool
+    processStart        = time.Now()
+    displayLocation     = time.Local
+    uptimeStore         *statsStore
+    commandAliases      map[string]bool
+    refreshButton       bool
+    refreshes           = newRefreshLimiter(defaultRefreshWait)
+    parseMode           string
+    botUsername         string
+    alertTemplate       *template.Template
+    snapshotDir         string
+    snapshotKeep        = defaultSnapshots
+    botLang             = defaultLang
+    alertGroupChats     = map[string]int64{}
+    healthPath          = defaultHealthPath
+    normalizePath       = true
+    defaultScheme       = "https"
+    probeBoth           bool
+    telegramAPI         = defaultTelegramAPI
+    batchTimeout        time.Duration
+    pollJitter          = true
+    probeUserAgent      = defaultUserAgent
+    probeAccept         = defaultAccept
+    backendDNS          *dnsCache
+    maxRedirects        = defaultRedirects
+    successStatus       = statusMatcher{codes: map[int]bool{http.StatusOK: true}}
+    latencyBounds       = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
 )
 
 type backendTarget struct {
-    display string
-    url     string
+    display   string
+    url       string
+    weight    int
+    group     string
+    alertChat int64
+    headers   http.Header
+    method    string
+    expect    string
 }
 
 type backendInfo struct {
@@ -49,14 +212,280 @@ type backendInfo struct {
     build     string
     buildDate string
     snippet   string
+    title     string
 }
 
 type backendResult struct {
-    ok     bool
+    ok         bool
+    status     int
+    err        string
+    typ        string
+    info       backendInfo
+    latency    time.Duration
+    skew       time.Duration
+    hasSkew    bool
+    attempts   int
+    certExpiry time.Time
+    oversized  bool
+    headers    http.Header
+    detail     string
+    finalURL   string
+    timings    phaseTimings
+    families   []familyStatus
+    bodySize   int
+    scheme     string
+}
+
+// familyStatus is the outcome of probing over one address family in
+// DUAL_STACK_PROBE mode.
+type familyStatus struct {
+    label string
+    ok    bool
+}
+
+// phaseTimings holds per-phase durations of a probe. Phases that did not run,
+// such as DNS and connect on a reused connection, stay zero.
+type phaseTimings struct {
+    dns     time.Duration
+    connect time.Duration
+    tls     time.Duration
+    ttfb    time.Duration
+}
+
+// timingTrace collects phaseTimings from httptrace callbacks, which may fire
+// on the transport's dial goroutines.
+type timingTrace struct {
+    mu           sync.Mutex
+    start        time.Time
+    dnsStart     time.Time
+    connectStart time.Time
+    tlsStart     time.Time
+    timings      phaseTimings
+}
+
+type jitterStats struct {
+    total   int
+    success int
+    min     time.Duration
+    max     time.Duration
+    avg     time.Duration
+    stddev  time.Duration
+}
+
+// targetSet is the parsed backend list, swapped atomically on reload.
+type targetSet struct {
+    targets   []backendTarget
+    truncated bool
+}
+
+type statusCache struct {
+    mu      sync.Mutex
+    key     string
+    results []backendResult
+    checked time.Time
+}
+
+// checkGroup coalesces concurrent checks of the same target set so they
+// share a single in-flight run.
+type checkGroup struct {
+    mu    sync.Mutex
+    calls map[string]*checkCall
+}
+
+type checkCall struct {
+    done    chan struct{}
+    results []backendResult
+    checked time.Time
+}
+
+type resettableTransport struct {
+    current atomic.Pointer[http.Transport]
+    proxy   func(*http.Request) (*url.URL, error)
+    dns     *dnsCache
+    guard   bool
+    mu      sync.Mutex
+    pinned  map[string]*http.Transport
+    strict  *http.Transport
+}
+
+// dnsCache remembers resolved backend addresses for ttl so repeated probes of
+// the same host skip the resolver. It holds at most dnsCacheSize hosts.
+type dnsCache struct {
+    mu      sync.Mutex
+    ttl     time.Duration
+    entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+    ips     []net.IP
+    expires time.Time
+}
+
+type watchdog struct {
+    mu      sync.Mutex
+    timeout time.Duration
+    last    time.Time
+    cancel  context.CancelFunc
+}
+
+// alert describes a backend state transition. Fields are exported so they can
+// be serialized for webhooks.
+type alert struct {
+    Name   string    `json:"name"`
+    URL    string    `json:"url"`
+    Online bool      `json:"online"`
+    Status string    `json:"status"`
+    Error  string    `json:"error,omitempty"`
+    Time   time.Time `json:"time"`
+    chatID int64
+}
+
+// doer sends HTTP requests. Functions that talk to Telegram or probe
+// backends take a doer rather than a concrete *http.Client so tests can
+// substitute a stub.
+type doer interface {
+    Do(req *http.Request) (*http.Response, error)
+}
+
+// notifier delivers alerts to one destination.
+type notifier interface {
+    Notify(ctx context.Context, a alert) error
+}
+
+// telegramNotifier sends alerts to Telegram chats. sem is shared by every
+// Notify call, so overlapping alerts together stay within MAX_CONCURRENCY.
+type telegramNotifier struct {
+    client  doer
+    token   string
+    chatIDs []int64
+    sem     chan struct{}
+}
+
+func newTelegramNotifier(client doer, token string, chatIDs []int64) *telegramNotifier {
+    return &telegramNotifier{client: client, token: token, chatIDs: chatIDs, sem: make(chan struct{}, maxConcurrency)}
+}
+
+type discordNotifier struct {
+    client     doer
+    webhookURL string
+}
+
+type webhookNotifier struct {
+    client doer
+    url    string
+}
+
+// rateLimiter is a token bucket. Callers reserve a token up front and wait
+// out any deficit, so bursts queue instead of being dropped.
+type rateLimiter struct {
+    mu     sync.Mutex
+    rate   float64
+    burst  float64
+    tokens float64
+    last   time.Time
+}
+
+type sendLimiter struct {
+    mu       sync.Mutex
+    global   *rateLimiter
+    perChat  map[int64]*rateLimiter
+    chatRate float64
+}
+
+// metrics holds the counters exposed on /metrics in Prometheus text format.
+type metrics struct {
+    mu             sync.Mutex
+    commands       map[string]uint64
+    probes         map[string]uint64
+    latencyBuckets []uint64
+    latencySum     float64
+    latencyCount   uint64
+    onlineBackends int
+    totalBackends  int
+}
+
+// alertTracker remembers the last reported state per backend URL and only
+// reports a transition once the new state held for confirm checks.
+type alertTracker struct {
+    mu      sync.Mutex
+    confirm int
+    states  map[string]*alertState
+}
+
+type alertState struct {
+    online bool
+    streak int
+}
+
+// circuitBreaker skips probing a backend URL after threshold consecutive
+// failures. Once cooldown has passed a single trial probe is let through;
+// success closes the breaker and failure opens it again.
+type circuitBreaker struct {
+    mu        sync.Mutex
+    threshold int
+    cooldown  time.Duration
+    states    map[string]*breakerState
+}
+
+type breakerState struct {
+    failures int
+    openedAt time.Time
+    trial    bool
+}
+
+// snapshot is the on-disk JSON record of one check run.
+type snapshot struct {
+    Time    time.Time       `json:"time"`
+    Results []snapshotEntry `json:"results"`
+}
+
+type snapshotEntry struct {
+    Display   string `json:"display"`
+    URL       string `json:"url"`
+    Online    bool   `json:"online"`
+    Status    int    `json:"status,omitempty"`
+    Error     string `json:"error,omitempty"`
+    Type      string `json:"type,omitempty"`
+    Version   string `json:"version,omitempty"`
+    LatencyMs int64  `json:"latency_ms"`
+}
+
+// statsStore accumulates per-target check counts from background polls and
+// persists them to STATS_FILE. Writes are batched by flush.
+type statsStore struct {
+    mu    sync.Mutex
+    path  string
+    dirty bool
+    data  statsFile
+}
+
+type statsFile struct {
+    Since   time.Time              `json:"since"`
+    Targets map[string]*statsEntry `json:"targets"`
+}
+
+type statsEntry struct {
+    Checks   int64 `json:"checks"`
+    Failures int64 `json:"failures"`
+}
+
+// statusMatcher decides which HTTP status codes count as a healthy backend,
+// by exact code or by class such as "2xx".
+type statusMatcher struct {
+    codes   map[int]bool
+    classes map[int]bool
+}
+
+type tokenRotator struct {
+    mu     sync.Mutex
+    tokens []string
+    next   int
+}
+
+type telegramError struct {
+    method string
     status int
-    err    string
-    typ    string
-    info   backendInfo
+    body   string
 }
 
 type updateResponse struct {
@@ -64,35 +493,125 @@ type updateResponse struct {
     Result []update `json:"result"`
 }
 
+// messageKey identifies a message across its original and edited versions.
+type messageKey struct {
+    chatID    int64
+    messageID int
+}
+
 type update struct {
-    UpdateID int      `json:"update_id"`
-    Message  *message `json:"message"`
+    UpdateID      int                `json:"update_id"`
+    Message       *message           `json:"message"`
+    EditedMessage *message           `json:"edited_message"`
+    ChannelPost   *message           `json:"channel_post"`
+    CallbackQuery *callbackQuery     `json:"callback_query"`
+    MyChatMember  *chatMemberUpdated `json:"my_chat_member"`
+}
+
+type callbackQuery struct {
+    ID      string   `json:"id"`
+    From    *user    `json:"from"`
+    Message *message `json:"message"`
+    Data    string   `json:"data"`
+}
+
+type chatMemberUpdated struct {
+    Chat          chat       `json:"chat"`
+    From          *user      `json:"from"`
+    OldChatMember chatMember `json:"old_chat_member"`
+    NewChatMember chatMember `json:"new_chat_member"`
+}
+
+type chatMember struct {
+    Status string `json:"status"`
 }
 
 type message struct {
-    Chat chat  `json:"chat"`
-    Text string `json:"text"`
-    From *user  `json:"from"`
+    MessageID       int    `json:"message_id"`
+    Chat            chat   `json:"chat"`
+    Text            string `json:"text"`
+    From            *user  `json:"from"`
+    MessageThreadID int    `json:"message_thread_id"`
 }
 
 type chat struct {
-    ID int64 `json:"id"`
+    ID    int64  `json:"id"`
+    Type  string `json:"type"`
+    Title string `json:"title"`
 }
 
 type user struct {
-    ID int64 `json:"id"`
+    ID       int64  `json:"id"`
+    Username string `json:"username"`
+}
+
+type getMeResponse struct {
+    Ok     bool `json:"ok"`
+    Result user `json:"result"`
+}
+
+type sendChatActionRequest struct {
+    ChatID          int64  `json:"chat_id"`
+    MessageThreadID int    `json:"message_thread_id,omitempty"`
+    Action          string `json:"action"`
 }
 
 type sendMessageRequest struct {
-    ChatID                int64  `json:"chat_id"`
-    Text                  string `json:"text"`
-    DisableWebPagePreview bool   `json:"disable_web_page_preview"`
+    ChatID                int64                 `json:"chat_id"`
+    MessageThreadID       int                   `json:"message_thread_id,omitempty"`
+    Text                  string                `json:"text"`
+    ParseMode             string                `json:"parse_mode,omitempty"`
+    DisableWebPagePreview bool                  `json:"disable_web_page_preview"`
+    ReplyToMessageID      int                   `json:"reply_to_message_id,omitempty"`
+    AllowWithoutReply     bool                  `json:"allow_sending_without_reply,omitempty"`
+    ReplyMarkup           *inlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+type editMessageTextRequest struct {
+    ChatID                int64                 `json:"chat_id"`
+    MessageID             int                   `json:"message_id"`
+    Text                  string                `json:"text"`
+    ParseMode             string                `json:"parse_mode,omitempty"`
+    DisableWebPagePreview bool                  `json:"disable_web_page_preview"`
+    ReplyMarkup           *inlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+type answerCallbackRequest struct {
+    CallbackQueryID string `json:"callback_query_id"`
+    Text            string `json:"text,omitempty"`
+}
+
+type inlineKeyboardMarkup struct {
+    InlineKeyboard [][]inlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type inlineKeyboardButton struct {
+    Text         string `json:"text"`
+    CallbackData string `json:"callback_data"`
+}
+
+// refreshLimiter enforces a minimum interval between refreshes of the same
+// status message.
+type refreshLimiter struct {
+    mu       sync.Mutex
+    cooldown time.Duration
+    last     map[messageKey]time.Time
 }
 
 func main() {
-    if len(os.Args) > 1 && os.Args[1] == "--healthcheck" {
-        if err := runHealthcheck(); err != nil {
-            log.Printf("healthcheck failed: %v", err)
+    configureLogging()
+    loadSettings()
+    if strings.TrimSpace(os.Getenv("CONFIG_FILE")) != "" {
+        reloadTargets()
+    }
+
+    if len(os.Args) > 1 && (os.Args[1] == "--healthcheck" || strings.HasPrefix(os.Args[1], "--healthcheck=")) {
+        mode := strings.TrimPrefix(strings.TrimPrefix(os.Args[1], "--healthcheck"), "=")
+        if mode == "" {
+            mode = strings.TrimSpace(os.Getenv("HEALTHCHECK_MODE"))
+        }
+        if err := runHealthcheck(mode); err != nil {
+            slog.Error("healthcheck failed", "error", err)
             os.Exit(1)
         }
         return
@@ -100,116 +619,4749 @@ func main() {
 
     token := strings.TrimSpace(os.Getenv("BOT_TOKEN"))
     if token == "" {
-        log.Fatal("BOT_TOKEN is not set")
+        slog.Error("BOT_TOKEN is not set")
+        os.Exit(1)
+    }
+    sendTokens = loadSendTokens(token)
+
+    client, probeClient := newHTTPClient()
+    me, err := verifyToken(client, token)
+    if err != nil {
+        if isInvalidToken(err) {
+            slog.Error("BOT_TOKEN 无效", "error", err)
+        } else {
+            slog.Error("getMe failed, giving up", "attempts", startupRetries, "error", err)
+        }
+        os.Exit(1)
+    }
+    botUsername = me.Username
+    slog.Info("bot started", "username", botUsername)
+    // Parsing the backend list now reports invalid entries at startup
+    // rather than on the first command.
+    loadBackendTargets()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    processCtx = ctx
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    go func() {
+        sig := <-signals
+        slog.Info("shutting down", "signal", sig.String())
+        cancel()
+    }()
+
+    hangups := make(chan os.Signal, 1)
+    signal.Notify(hangups, syscall.SIGHUP)
+    go func() {
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-hangups:
+                reloadTargets()
+            }
+        }
+    }()
+
+    offsetFile := strings.TrimSpace(os.Getenv("OFFSET_FILE"))
+    if offsetFile == "" {
+        offsetFile = defaultOffsetFile
+    }
+    offsets := newOffsetTracker(loadOffset(offsetFile))
+
+    workerCount := envInt("WORKER_COUNT", defaultWorkers, 1, maxWorkers)
+    jobs := make(chan update, updateQueueSize)
+    var wg sync.WaitGroup
+
+    for i := 0; i < workerCount; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            runWorker(ctx, jobs, offsets, func(ctx context.Context, item update) {
+                handleUpdate(ctx, client, probeClient, token, item)
+            })
+        }()
+    }
+
+    alertNotifiers = loadNotifiers(client, token)
+
+    if listen := strings.TrimSpace(os.Getenv("METRICS_LISTEN")); listen != "" {
+        go serveMetrics(ctx, listen)
+    }
+
+    if envBool("CACHE_REFRESH", false) {
+        switch {
+        case pollInterval > 0:
+            // The background poller already keeps the cache warm; running
+            // both would probe every backend twice.
+            slog.Warn("CACHE_REFRESH ignored because POLL_INTERVAL_SECONDS is set")
+        case statusCacheTTL > 0:
+            go runCacheRefresher(ctx, probeClient)
+        default:
+            slog.Warn("CACHE_REFRESH ignored because STATUS_CACHE_TTL is 0")
+        }
+    }
+
+    if path := strings.TrimSpace(os.Getenv("STATS_FILE")); path != "" {
+        uptimeStore = loadStatsStore(path)
+        go uptimeStore.run(ctx)
+        if pollInterval <= 0 {
+            slog.Warn("STATS_FILE only records background polls, set POLL_INTERVAL_SECONDS")
+        }
+    }
+
+    if pollInterval > 0 {
+        go runBackgroundPoller(ctx, probeClient)
+    }
+
+    wd := newWatchdog(watchdogTimeout(envSeconds("WATCHDOG_TIMEOUT", defaultWatchdog)))
+    if wd.timeout > 0 {
+        go wd.run(ctx, client)
+    }
+
+    if listen := strings.TrimSpace(os.Getenv("HEALTH_LISTEN")); listen != "" {
+        go serveHealth(ctx, listen, wd)
+    }
+
+    pollErr := pollUpdates(ctx, client, token, jobs, offsets, offsetFile, wd)
+    close(jobs)
+
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        slog.Info("shutdown complete")
+    case <-time.After(shutdownTimeout):
+        slog.Warn("shutdown timed out, exiting with workers still running", "timeout", shutdownTimeout.String())
+    }
+    // Updates cut short or skipped by the shutdown, or still running when it
+    // timed out, are left out of the saved offset so Telegram delivers them
+    // again after the restart.
+    saveOffset(offsetFile, offsets.committed())
+    if uptimeStore != nil {
+        uptimeStore.flush()
+    }
+    if pollErr != nil {
+        slog.Error("polling stopped", "error", pollErr)
+        os.Exit(1)
+    }
+}
+
+// runWorker handles queued updates until jobs is closed, marking each one
+// finished in offsets. Once ctx is done the remaining updates are skipped, and
+// neither they nor one aborted midway are marked, so a restart answers them.
+func runWorker(ctx context.Context, jobs <-chan update, offsets *offsetTracker, handle func(context.Context, update)) {
+    for item := range jobs {
+        if ctx.Err() != nil {
+            continue
+        }
+        handle(ctx, item)
+        if ctx.Err() == nil {
+            offsets.finish(item.UpdateID)
+        }
+    }
+}
+
+// configureLogging switches the default logger to JSON lines when
+// LOG_FORMAT=json. Otherwise slog keeps writing human-readable lines through
+// the standard log package.
+func configureLogging() {
+    switch format := strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT"))); format {
+    case "", "text":
+    case "json":
+        slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+    default:
+        slog.Warn("unsupported LOG_FORMAT, using text", "value", format)
+    }
+}
+
+func loadSettings() {
+    telegramAPI = loadTelegramAPI()
+    requestTimeout = time.Duration(envInt("REQUEST_TIMEOUT_SECONDS", int(defaultTimeout.Seconds()), 1, 120)) * time.Second
+    maxConcurrency = envInt("MAX_CONCURRENCY", defaultConcurrency, 1, 50)
+    maxBackends = envInt("MAX_BACKENDS", defaultMaxBackends, 1, 200)
+    backendRetries = envInt("BACKEND_RETRIES", defaultRetries, 0, 5)
+    deepProbeURL = strings.TrimSpace(os.Getenv("DEEP_PROBE_URL"))
+    certWarnDays = envInt("CERT_WARN_DAYS", defaultCertWarn, 0, 365)
+    adminIDs = envIDSet("ADMIN_IDS")
+    pollInterval = envSeconds("POLL_INTERVAL_SECONDS", 0)
+    transitions = newAlertTracker(envInt("ALERT_CONFIRM_COUNT", 1, 1, 100))
+    breakers = newCircuitBreaker(envInt("BREAKER_THRESHOLD", 0, 0, 1000), envSeconds("BREAKER_COOLDOWN", defaultCooldown))
+    welcomeEnabled = envBool("WELCOME_MESSAGE", false)
+    replyToMessage = envBool("REPLY_TO_MESSAGE", false)
+    insecureSkipAll = envBool("INSECURE_SKIP_VERIFY", false)
+    insecureHosts = loadInsecureHosts()
+    if insecureSkipAll {
+        slog.Warn("INSECURE_SKIP_VERIFY is enabled, TLS certificates of backends are NOT verified")
+    } else if len(insecureHosts) > 0 {
+        slog.Warn("TLS certificate verification is disabled for hosts in INSECURE_HOSTS", "hosts", len(insecureHosts))
+    }
+    parseMode = loadParseMode()
+    snapshotDir = strings.TrimSpace(os.Getenv("SNAPSHOT_DIR"))
+    snapshotKeep = envInt("SNAPSHOT_KEEP", defaultSnapshots, 1, 100000)
+    successStatus = loadSuccessStatus()
+    alertTemplate = loadAlertTemplate()
+    botLang = loadLang()
+    alertGroupChats = loadGroupChats()
+    healthPath = loadHealthPath()
+    normalizePath = envBool("NORMALIZE_PATH", true)
+    defaultScheme = loadDefaultScheme()
+    probeBoth = envBool("PROBE_BOTH", false)
+    batchTimeout = envSeconds("BATCH_TIMEOUT_SECONDS", 0)
+    pollJitter = envBool("POLL_JITTER", true)
+    probeMethod = parseProbeMethod(os.Getenv("PROBE_METHOD"), "PROBE_METHOD")
+    if probeMethod == "" {
+        probeMethod = http.MethodGet
+    }
+    expectContains = os.Getenv("EXPECT_CONTAINS")
+    maintenancePattern = loadMaintenancePattern()
+    probeUserAgent = envString("PROBE_USER_AGENT", defaultUserAgent)
+    probeAccept = envString("PROBE_ACCEPT", defaultAccept)
+    if ttl := envSeconds("DNS_CACHE_TTL", defaultDNSCacheTTL); ttl > 0 {
+        backendDNS = newDNSCache(ttl)
+    }
+    latencyWarn = time.Duration(envInt("LATENCY_WARN_MS", int(defaultLatencyWarn.Milliseconds()), 1, 60000)) * time.Millisecond
+    latencyBad = time.Duration(envInt("LATENCY_BAD_MS", int(defaultLatencyBad.Milliseconds()), 1, 60000)) * time.Millisecond
+    dualStackProbe = envBool("DUAL_STACK_PROBE", false)
+    displayLocation = loadDisplayLocation()
+    commandAliases = loadCommandAliases()
+    pollTimeout = time.Duration(envInt("POLL_TIMEOUT_SECONDS", int(defaultPollTimeout.Seconds()), 0, maxPollTimeout)) * time.Second
+    allowedUpdates = loadAllowedUpdates()
+    channelPosts = envBool("CHANNEL_POSTS", false)
+    if channelPosts && !slices.Contains(allowedUpdates, "channel_post") {
+        allowedUpdates = append(allowedUpdates, "channel_post")
     }
+    refreshButton = envBool("REFRESH_BUTTON", true)
+    refreshes = newRefreshLimiter(envSeconds("REFRESH_COOLDOWN_SECONDS", defaultRefreshWait))
+    if refreshButton && !slices.Contains(allowedUpdates, "callback_query") {
+        allowedUpdates = append(allowedUpdates, "callback_query")
+    }
+    maxRedirects = envInt("MAX_REDIRECTS", defaultRedirects, 0, 20)
+    outboundLimiter = newSendLimiter(
+        envInt("SEND_RPS", defaultSendRPS, 1, 1000),
+        envInt("SEND_CHAT_PER_MINUTE", defaultChatPerMin, 1, 1000),
+    )
+    statusCacheTTL = envSeconds("STATUS_CACHE_TTL", defaultCacheTTL)
+    redactPatterns = loadRedactPatterns()
+    minOnlinePercent = float64(envInt("MIN_ONLINE_PERCENT", 0, 0, 100))
+    allowPrivateTargets = envBool("ALLOW_PRIVATE_TARGETS", false)
+    diagMode = envBool("DIAG", false)
+    traceTimings = envBool("TRACE_TIMINGS", false)
+    sortMode = loadSortMode()
+}
 
-    client := newHTTPClient()
-    offset := 0
+// pollUpdates feeds updates to jobs until ctx ends. After each batch it saves
+// the offset the workers have finished up to; the caller saves the final one
+// once the queue is drained. It only returns an error when EXIT_ON_CONFLICT
+// gives up after repeated 409 conflicts.
+func pollUpdates(ctx context.Context, client doer, token string, jobs chan<- update, offsets *offsetTracker, offsetFile string, wd *watchdog) error {
+    offset := offsets.committed()
+    saved := offset
 
+    exitOnConflict := envBool("EXIT_ON_CONFLICT", false)
+    conflictLimit := envInt("CONFLICT_LIMIT", 5, 1, 1000)
+    conflicts := 0
+    backoff := pollBackoffBase
     for {
-        updates, err := getUpdates(client, token, offset)
+        pollCtx, pollCancel := context.WithCancel(ctx)
+        wd.setCancel(pollCancel)
+        updates, err := getUpdates(pollCtx, client, token, offset)
+        pollCancel()
+        if ctx.Err() != nil {
+            return nil
+        }
+        wd.beat()
+        if isConflict(err) {
+            // Another instance is polling with the same token. Back off long
+            // enough for one of the two to win, typically the newer deploy.
+            conflicts++
+            slog.Warn("检测到另一个实例正在运行", "error", err, "conflicts", conflicts, "retry_in", conflictBackoff.String())
+            if exitOnConflict && conflicts >= conflictLimit {
+                return fmt.Errorf("getUpdates conflicted %d times in a row: %w", conflicts, err)
+            }
+            wd.extend(conflictBackoff)
+            if !sleepContext(ctx, conflictBackoff) {
+                return nil
+            }
+            continue
+        }
+        conflicts = 0
         if err != nil {
-            log.Printf("getUpdates error: %v", err)
-            time.Sleep(2 * time.Second)
+            delay := backoff
+            if retryAfter := telegramRetryAfter(err); retryAfter > 0 {
+                delay = retryAfter
+            }
+            slog.Error("getUpdates failed", "error", err, "retry_in", delay.String())
+            wd.extend(delay)
+            if !sleepContext(ctx, delay) {
+                return nil
+            }
+            backoff = min(backoff*2, pollBackoffMax)
             continue
         }
+        backoff = pollBackoffBase
+        pollReady.Store(true)
 
+        // A command and its edit arriving in the same batch are answered once.
+        seen := make(map[messageKey]bool, len(updates))
         for _, item := range updates {
+            if firstInBatch(seen, item) {
+                offsets.start(item.UpdateID)
+                select {
+                case jobs <- item:
+                case <-ctx.Done():
+                    offsets.finish(item.UpdateID)
+                    return nil
+                }
+            }
             if item.UpdateID >= offset {
                 offset = item.UpdateID + 1
             }
-            if item.Message == nil {
-                continue
-            }
-            if !isBackendCommand(item.Message.Text) {
-                continue
-            }
+            offsets.advance(offset)
+        }
 
-            reply := buildStatusMessage(client)
-            if err := sendMessage(client, token, item.Message.Chat.ID, reply); err != nil {
-                log.Printf("sendMessage error: %v", err)
-            }
+        if committed := offsets.committed(); committed != saved {
+            saveOffset(offsetFile, committed)
+            saved = committed
         }
     }
 }
 
-func runHealthcheck() error {
-    targets, _ := loadBackendTargets()
-    if len(targets) == 0 {
-        return errors.New("no backend targets configured")
+// commandMessage returns the message an update carries, treating an edited
+// message like a new one so fixing a typo in a command still gets an answer.
+// Channel posts count only when CHANNEL_POSTS is enabled; they carry no From,
+// so admin-only commands and the dm flag never apply to them.
+func (u update) commandMessage() *message {
+    if u.Message != nil {
+        return u.Message
     }
+    if u.EditedMessage != nil {
+        return u.EditedMessage
+    }
+    if channelPosts {
+        return u.ChannelPost
+    }
+    return nil
+}
 
-    client := newHTTPClient()
-    result := fetchBackendInfo(client, targets[0].url)
-    if !result.ok {
-        return fmt.Errorf("backend offline: %s", result.err)
+// firstInBatch reports whether item is the first update seen for its chat
+// message, recording it in seen. Updates without a message always pass.
+func firstInBatch(seen map[messageKey]bool, item update) bool {
+    msg := item.commandMessage()
+    if msg == nil {
+        return true
+    }
+    key := messageKey{chatID: msg.Chat.ID, messageID: msg.MessageID}
+    if seen[key] {
+        return false
+    }
+    seen[key] = true
+    return true
+}
+
+// offsetTracker tracks which polled updates the workers have finished, so the
+// saved offset never skips past an update that is still queued or running.
+type offsetTracker struct {
+    mu      sync.Mutex
+    next    int
+    pending map[int]bool
+}
+
+func newOffsetTracker(offset int) *offsetTracker {
+    return &offsetTracker{next: offset, pending: make(map[int]bool)}
+}
+
+// start records an update handed to the workers.
+func (t *offsetTracker) start(id int) {
+    t.mu.Lock()
+    t.pending[id] = true
+    t.mu.Unlock()
+}
+
+// finish records that the workers are done with an update.
+func (t *offsetTracker) finish(id int) {
+    t.mu.Lock()
+    delete(t.pending, id)
+    t.mu.Unlock()
+}
+
+// advance moves the offset past every update polled so far.
+func (t *offsetTracker) advance(offset int) {
+    t.mu.Lock()
+    if offset > t.next {
+        t.next = offset
+    }
+    t.mu.Unlock()
+}
+
+// committed returns the offset to persist: the oldest unfinished update, or
+// the polled offset when nothing is pending.
+func (t *offsetTracker) committed() int {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    offset := t.next
+    for id := range t.pending {
+        if id < offset {
+            offset = id
+        }
+    }
+    return offset
+}
+
+func loadOffset(path string) int {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if !errors.Is(err, os.ErrNotExist) {
+            slog.Error("read offset file failed", "path", path, "error", err)
+        }
+        return 0
+    }
+
+    offset, err := strconv.Atoi(strings.TrimSpace(string(data)))
+    if err != nil || offset < 0 {
+        slog.Warn("malformed offset file, starting from 0", "path", path)
+        return 0
+    }
+    return offset
+}
+
+func saveOffset(path string, offset int) {
+    if err := writeFileAtomic(path, []byte(strconv.Itoa(offset)+"\n")); err != nil {
+        slog.Error("write offset file failed", "path", path, "error", err)
+    }
+}
+
+func writeFileAtomic(path string, data []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    tmpName := tmp.Name()
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        os.Remove(tmpName)
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        os.Remove(tmpName)
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmpName)
+        return err
+    }
+
+    if err := os.Rename(tmpName, path); err != nil {
+        os.Remove(tmpName)
+        return err
     }
     return nil
 }
 
-func newHTTPClient() *http.Client {
-    transport := &http.Transport{
-        Proxy:               http.ProxyFromEnvironment,
-        MaxIdleConns:        20,
-        MaxIdleConnsPerHost: maxConcurrency,
-        IdleConnTimeout:     30 * time.Second,
-        TLSHandshakeTimeout: 10 * time.Second,
-        ExpectContinueTimeout: 1 * time.Second,
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+
+    select {
+    case <-timer.C:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// handleUpdate answers a single update. Telegram calls go through client and
+// backend probes through probes, so each can use its own proxy.
+func handleUpdate(ctx context.Context, client, probes doer, token string, item update) {
+    if item.MyChatMember != nil {
+        handleMembership(ctx, client, token, item.MyChatMember)
+        return
+    }
+    if item.CallbackQuery != nil {
+        handleCallback(ctx, client, probes, token, item.CallbackQuery)
+        return
+    }
+    msg := item.commandMessage()
+    if msg == nil {
+        return
+    }
+
+    var reply, mode string
+    var document []byte
+    var markup *inlineKeyboardMarkup
+    command, args := splitCommand(msg.Text)
+    args, private := extractDMFlag(args)
+    stopTyping := func() {}
+    if isBackendCommand(msg.Text) || command == "/jitter" || command == "/convlat" || command == "/consistency" {
+        stopTyping = startTyping(ctx, client, token, msg.Chat.ID, msg.MessageThreadID)
+    }
+
+    switch {
+    case isBackendCommand(msg.Text) && len(args) == 1 && args[0] == "json":
+        reply, document = buildStatusJSON(ctx, probes)
+        mode = markdownV2
+    case isBackendCommand(msg.Text):
+        reply = buildBackendReply(ctx, probes, args)
+        mode = parseMode
+        if filter, ok := statusFilter(args); ok && refreshButton {
+            markup = refreshMarkup(filter)
+        }
+    case command == "/jitter":
+        reply = buildJitterMessage(ctx, probes, args)
+    case command == "/convlat":
+        reply = buildConvertLatencyMessage(ctx, probes, args)
+    case command == "/version":
+        reply = buildVersionMessage()
+    case command == "/consistency":
+        reply = buildConsistencyMessage(ctx, probes)
+    case command == "/stats":
+        reply = buildStatsMessage()
+    case command == "/ping":
+        reply = buildPingMessage(client, token)
+    case command == "/headers":
+        if !isAdmin(msg.From) {
+            reply = "该命令仅管理员可用。"
+            break
+        }
+        reply = buildHeadersMessage(ctx, probes, args)
+        mode = markdownV2
+    default:
+        stopTyping()
+        return
+    }
+    stopTyping()
+    botMetrics.recordCommand(strings.TrimPrefix(commandName(msg.Text), "/"))
+
+    chatID := msg.Chat.ID
+    destination, redirected := resolveDestination(msg, private)
+    send := func(target int64, thread, replyTo int, prefix string) error {
+        if document != nil {
+            return sendDocument(ctx, client, token, target, thread, replyTo, statusDocument, document, prefix)
+        }
+        return sendMessageChunked(ctx, client, token, target, thread, replyTo, prefix+reply, mode, markup)
+    }
+    replyTo := 0
+    if replyToMessage {
+        replyTo = msg.MessageID
+    }
+    // Topic threads and the command message only exist in the originating
+    // group, not in a DM.
+    thread, quoted := msg.MessageThreadID, replyTo
+    if redirected {
+        thread, quoted = 0, 0
+    }
+    err := send(destination, thread, quoted, "")
+    if redirected && isForbidden(err) {
+        slog.Warn("sendMessage to user forbidden, falling back to chat", "user_id", destination, "chat_id", chatID)
+        note := "⚠️ 无法私聊发送，请先私聊机器人发送 /start。"
+        if mode == markdownV2 && document == nil {
+            note = escapeMarkdownV2(note)
+        }
+        if document == nil {
+            note += "\n\n"
+        }
+        err = send(chatID, msg.MessageThreadID, replyTo, note)
+    }
+    if err != nil {
+        slog.Error("sendMessage failed", "chat_id", chatID, "error", err)
+    }
+}
+
+// handleCallback serves the refresh button under a status message by
+// re-running the check and editing the message in place.
+func handleCallback(ctx context.Context, client, probes doer, token string, query *callbackQuery) {
+    filter, ok := "", query.Data == "refresh"
+    if arg, found := strings.CutPrefix(query.Data, "refresh:"); found {
+        filter, ok = statusFilter([]string{arg})
+    }
+    if !ok || query.Message == nil {
+        answerCallback(client, token, query.ID, "")
+        return
+    }
+    msg := query.Message
+    if !refreshes.allow(messageKey{chatID: msg.Chat.ID, messageID: msg.MessageID}, time.Now()) {
+        answerCallback(client, token, query.ID, "刷新太频繁，请稍后再试。")
+        return
+    }
+    // Answer first so the client stops its spinner while the check runs.
+    answerCallback(client, token, query.ID, "")
+    botMetrics.recordCommand("refresh")
+
+    reply := buildStatusMessage(ctx, probes, filter)
+    if messageLength(reply) > messageLimit {
+        slog.Warn("refreshed status exceeds message limit, not editing", "chat_id", msg.Chat.ID)
+        return
+    }
+    err := editMessageText(ctx, client, token, msg.Chat.ID, msg.MessageID, reply, parseMode, refreshMarkup(filter))
+    if err != nil && !isNotModified(err) {
+        slog.Error("editMessageText failed", "chat_id", msg.Chat.ID, "error", err)
+    }
+}
+
+// statusFilter reports whether args ask for the full status report, and the
+// online/offline filter they select.
+func statusFilter(args []string) (string, bool) {
+    switch {
+    case len(args) == 0:
+        return "", true
+    case len(args) == 1 && (args[0] == "online" || args[0] == "offline"):
+        return args[0], true
+    default:
+        return "", false
+    }
+}
+
+func refreshMarkup(filter string) *inlineKeyboardMarkup {
+    data := "refresh"
+    if filter != "" {
+        data += ":" + filter
+    }
+    return &inlineKeyboardMarkup{InlineKeyboard: [][]inlineKeyboardButton{{{Text: "🔄 刷新", CallbackData: data}}}}
+}
+
+func newRefreshLimiter(cooldown time.Duration) *refreshLimiter {
+    return &refreshLimiter{cooldown: cooldown, last: map[messageKey]time.Time{}}
+}
+
+func (l *refreshLimiter) allow(key messageKey, now time.Time) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if last, ok := l.last[key]; ok && now.Sub(last) < l.cooldown {
+        return false
+    }
+    if len(l.last) >= limiterIdleChats {
+        for existing, last := range l.last {
+            if now.Sub(last) >= l.cooldown {
+                delete(l.last, existing)
+            }
+        }
+    }
+    l.last[key] = now
+    return true
+}
+
+func isNotModified(err error) bool {
+    var apiErr *telegramError
+    return errors.As(err, &apiErr) && apiErr.status == http.StatusBadRequest && strings.Contains(apiErr.body, "message is not modified")
+}
+
+// handleMembership reacts to the bot's own membership changing in a chat.
+func handleMembership(ctx context.Context, client doer, token string, change *chatMemberUpdated) {
+    if !isJoinTransition(change.OldChatMember.Status, change.NewChatMember.Status) {
+        return
+    }
+
+    slog.Info("bot added to chat", "chat_id", change.Chat.ID, "chat_type", change.Chat.Type, "title", change.Chat.Title)
+    if !welcomeEnabled {
+        return
+    }
+    if err := sendMessage(ctx, client, token, change.Chat.ID, welcomeText()); err != nil {
+        slog.Error("sendMessage failed", "chat_id", change.Chat.ID, "error", err)
+    }
+}
+
+func isJoinTransition(oldStatus, newStatus string) bool {
+    wasOut := oldStatus == "left" || oldStatus == "kicked" || oldStatus == ""
+    isIn := newStatus == "member" || newStatus == "administrator"
+    return wasOut && isIn
+}
+
+func welcomeText() string {
+    return strings.Join([]string{
+        "👋 你好，我是后端状态监控机器人。",
+        "",
+        "/backend - 检查后端状态",
+        "/backend <地址> - 临时检测指定后端",
+        "/jitter <序号> [次数] - 延迟抖动测试",
+        "/convlat <序号> - 订阅转换延迟测试",
+        "/consistency - 检查各后端版本是否一致",
+        "/stats - 查看各后端历史可用率",
+        "/version - 查看机器人版本",
+        "/ping - 检查机器人与 Telegram 的连接",
+    }, "\n")
+}
+
+// extractDMFlag removes a "dm" argument, which asks for the reply to be sent
+// to the requesting user's private chat instead of the group.
+func extractDMFlag(args []string) ([]string, bool) {
+    rest := make([]string, 0, len(args))
+    private := false
+    for _, arg := range args {
+        if strings.EqualFold(arg, "dm") {
+            private = true
+            continue
+        }
+        rest = append(rest, arg)
+    }
+    return rest, private
+}
+
+func resolveDestination(msg *message, private bool) (int64, bool) {
+    if !private || msg.From == nil || msg.From.ID == msg.Chat.ID {
+        return msg.Chat.ID, false
+    }
+    return msg.From.ID, true
+}
+
+func isRateLimited(err error) bool {
+    var apiErr *telegramError
+    return errors.As(err, &apiErr) && apiErr.status == http.StatusTooManyRequests
+}
+
+func newTokenRotator(tokens []string) *tokenRotator {
+    return &tokenRotator{tokens: tokens}
+}
+
+// order returns the tokens to try for one send: the primary alone when no
+// extra tokens are configured, otherwise all tokens starting at the next
+// round-robin position.
+func (r *tokenRotator) order(primary string) []string {
+    if r == nil || len(r.tokens) == 0 {
+        return []string{primary}
+    }
+
+    r.mu.Lock()
+    start := r.next
+    r.next = (r.next + 1) % len(r.tokens)
+    r.mu.Unlock()
+
+    ordered := make([]string, 0, len(r.tokens))
+    for i := range r.tokens {
+        ordered = append(ordered, r.tokens[(start+i)%len(r.tokens)])
+    }
+    return ordered
+}
+
+// telegramRetryAfter returns the wait Telegram asked for in a 429 response,
+// or zero when the error carries no retry_after hint.
+func telegramRetryAfter(err error) time.Duration {
+    var apiErr *telegramError
+    if !errors.As(err, &apiErr) || apiErr.status != http.StatusTooManyRequests {
+        return 0
+    }
+
+    var decoded struct {
+        Parameters struct {
+            RetryAfter int `json:"retry_after"`
+        } `json:"parameters"`
+    }
+    if err := json.Unmarshal([]byte(apiErr.body), &decoded); err != nil {
+        return 0
+    }
+    return time.Duration(decoded.Parameters.RetryAfter) * time.Second
+}
+
+// isConflict reports whether getUpdates failed because another instance is
+// polling with the same token.
+func isConflict(err error) bool {
+    var apiErr *telegramError
+    return errors.As(err, &apiErr) && apiErr.status == http.StatusConflict
+}
+
+// isTooLong reports whether Telegram rejected a message for exceeding its
+// length limit. Other 400 errors are real failures.
+func isTooLong(err error) bool {
+    var apiErr *telegramError
+    return errors.As(err, &apiErr) && apiErr.status == http.StatusBadRequest && strings.Contains(apiErr.body, "message is too long")
+}
+
+func isForbidden(err error) bool {
+    var apiErr *telegramError
+    return errors.As(err, &apiErr) && apiErr.status == http.StatusForbidden
+}
+
+// runHealthcheck probes the first backend, or every backend when mode is
+// "all", and fails if any probed backend is offline.
+func runHealthcheck(mode string) error {
+    targets, _ := loadBackendTargets()
+    if len(targets) == 0 {
+        return errors.New("no backend targets configured")
+    }
+
+    _, probes := newHTTPClient()
+    if mode == "all" {
+        // A healthcheck run is not a real check; keep it out of the history.
+        snapshotDir = ""
+        var failed []string
+        for i, result := range checkBackends(context.Background(), probes, targets) {
+            if !result.ok {
+                failed = append(failed, fmt.Sprintf("%s (%s)", targets[i].display, result.err))
+            }
+        }
+        if len(failed) > 0 {
+            return fmt.Errorf("%d/%d backends offline: %s", len(failed), len(targets), strings.Join(failed, ", "))
+        }
+        return nil
+    }
+
+    result := fetchBackendInfo(context.Background(), probes, targets[0])
+    if !result.ok {
+        return fmt.Errorf("backend offline: %s", result.err)
+    }
+    return nil
+}
+
+// newHTTPClient returns the client for the Telegram API and the client for
+// backend probes, configured with TELEGRAM_PROXY and BACKEND_PROXY.
+func newHTTPClient() (*http.Client, *http.Client) {
+    return newProxiedClient(loadProxy("TELEGRAM_PROXY"), nil, false), newProxiedClient(loadProxy("BACKEND_PROXY"), backendDNS, true)
+}
+
+// newProxiedClient returns a client using proxy and dns. With guard set, the
+// private-target guard also applies to redirects and dialed addresses.
+func newProxiedClient(proxy func(*http.Request) (*url.URL, error), dns *dnsCache, guard bool) *http.Client {
+    transport := &resettableTransport{proxy: proxy, dns: dns, guard: guard}
+    transport.current.Store(newTransport(proxy, dns, guard))
+
+    checkRedirect := limitRedirects
+    if guard {
+        checkRedirect = guardRedirects
+    }
+    return &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+}
+
+// loadProxy reads a proxy URL (http, https, socks5 or socks5h) from the named
+// variable. Unset falls back to the standard proxy environment variables and
+// "direct" disables proxying.
+func loadProxy(name string) func(*http.Request) (*url.URL, error) {
+    raw := strings.TrimSpace(os.Getenv(name))
+    switch strings.ToLower(raw) {
+    case "":
+        return http.ProxyFromEnvironment
+    case "direct", "none":
+        return nil
+    }
+
+    parsed, err := url.Parse(raw)
+    if err != nil || parsed.Host == "" {
+        slog.Warn("invalid proxy, using proxy environment variables", "env", name)
+        return http.ProxyFromEnvironment
+    }
+    switch parsed.Scheme {
+    case "http", "https", "socks5", "socks5h":
+        return http.ProxyURL(parsed)
+    default:
+        slog.Warn("unsupported proxy scheme, using proxy environment variables", "env", name, "scheme", parsed.Scheme)
+        return http.ProxyFromEnvironment
+    }
+}
+
+// limitRedirects stops following redirects after MAX_REDIRECTS hops. The
+// resulting error surfaces from the probe as a connection failure.
+func limitRedirects(req *http.Request, via []*http.Request) error {
+    if len(via) > maxRedirects {
+        return fmt.Errorf("stopped after %d redirects", maxRedirects)
+    }
+    return nil
+}
+
+// guardRedirects applies limitRedirects and checks every hop against the
+// private-target guard, since a public backend may redirect inward.
+func guardRedirects(req *http.Request, via []*http.Request) error {
+    if err := limitRedirects(req, via); err != nil {
+        return err
+    }
+    return checkTargetAllowed(req.Context(), req.URL.String())
+}
+
+// newTransport builds a transport using proxy. When dns is non-nil, host
+// names are resolved through it. When guard is set, direct connections to
+// private addresses are refused after resolution.
+func newTransport(proxy func(*http.Request) (*url.URL, error), dns *dnsCache, guard bool) *http.Transport {
+    transport := &http.Transport{
+        Proxy:               proxy,
+        MaxIdleConns:        20,
+        MaxIdleConnsPerHost: maxConcurrency,
+        IdleConnTimeout:     30 * time.Second,
+        TLSHandshakeTimeout: 10 * time.Second,
+        ExpectContinueTimeout: 1 * time.Second,
+    }
+    if insecureSkipAll || len(insecureHosts) > 0 {
+        // Direct connections pick the verification mode per host in dialTLS.
+        // Connections through a proxy are handshaked by the transport itself
+        // and fall back to verifyConnection, which only sees hostnames;
+        // RoundTrip sends verified IP literals to a strict transport instead.
+        transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true, VerifyConnection: verifyConnection}
+    }
+
+    dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+    if guard {
+        dialer.Control = refusePrivateAddr
+    }
+    dial, dialTLSConn := dialer.DialContext, dialTLS(dialer)
+    if dns != nil {
+        dial, dialTLSConn = dns.dialer(dial), dns.dialer(dialTLSConn)
+    }
+    if guard {
+        // The proxy itself may well live on a private address.
+        if proxies := proxyAddrs(proxy); len(proxies) > 0 {
+            direct := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+            guarded := dial
+            dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+                if proxies[addr] {
+                    return direct.DialContext(ctx, network, addr)
+                }
+                return guarded(ctx, network, addr)
+            }
+        }
+    }
+    transport.DialContext = dial
+    if transport.TLSClientConfig != nil {
+        transport.DialTLSContext = dialTLSConn
+    }
+    return transport
+}
+
+// dialTLS returns a TLS dial function on top of dialer that picks the
+// verification mode per host.
+func dialTLS(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+    return func(ctx context.Context, network, addr string) (net.Conn, error) {
+        host, _, err := net.SplitHostPort(addr)
+        if err != nil {
+            return nil, err
+        }
+        // The DNS cache dials resolved addresses; the original host name is
+        // still the one to verify.
+        if name, ok := ctx.Value(dialHostKey{}).(string); ok {
+            host = name
+        }
+        tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host, InsecureSkipVerify: skipVerify(host)}}
+        return tlsDialer.DialContext(ctx, network, addr)
+    }
+}
+
+// refusePrivateAddr is a net.Dialer Control hook that rejects private
+// addresses once they are resolved, so neither redirects nor DNS answers
+// that change after checkTargetAllowed can reach internal hosts.
+func refusePrivateAddr(_, address string, _ syscall.RawConn) error {
+    if allowPrivateTargets {
+        return nil
+    }
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+    if i := strings.IndexByte(host, '%'); i >= 0 {
+        host = host[:i]
+    }
+    if ip := net.ParseIP(host); ip != nil && isPrivateIP(ip) {
+        return fmt.Errorf("%w: address %s is private", errBlockedTarget, ip)
+    }
+    return nil
+}
+
+// proxyAddrs returns the host:port of every proxy the transport may dial, so
+// the private-address guard can let those connections through.
+func proxyAddrs(proxy func(*http.Request) (*url.URL, error)) map[string]bool {
+    addrs := map[string]bool{}
+    if proxy == nil {
+        return addrs
+    }
+    defaultPorts := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}
+    for _, scheme := range []string{"http", "https"} {
+        proxyURL, err := proxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: "example.com"}})
+        if err != nil || proxyURL == nil {
+            continue
+        }
+        port := proxyURL.Port()
+        if port == "" {
+            port = defaultPorts[proxyURL.Scheme]
+        }
+        addrs[net.JoinHostPort(proxyURL.Hostname(), port)] = true
+    }
+    return addrs
+}
+
+// dialHostKey carries the host name being dialed when the address passed to
+// a dial function is an already-resolved IP.
+type dialHostKey struct{}
+
+// dialNetworkKey pins the requests made with a context to one address family
+// ("tcp4" or "tcp6") on a resettableTransport.
+type dialNetworkKey struct{}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+    return &dnsCache{ttl: ttl, entries: map[string]dnsEntry{}}
+}
+
+// lookup resolves host, serving fresh cached addresses when available. If the
+// resolver fails, expired addresses are reused rather than failing the probe.
+// A nil cache always asks the resolver.
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]net.IP, error) {
+    if ip := net.ParseIP(host); ip != nil {
+        return []net.IP{ip}, nil
+    }
+    if c == nil {
+        return resolveIPs(ctx, host)
+    }
+
+    now := time.Now()
+    c.mu.Lock()
+    entry, ok := c.entries[host]
+    c.mu.Unlock()
+    if ok && now.Before(entry.expires) {
+        return entry.ips, nil
+    }
+
+    ips, err := resolveIPs(ctx, host)
+    if err != nil {
+        if ok {
+            slog.Warn("DNS lookup failed, using cached addresses", "host", host, "error", err)
+            return entry.ips, nil
+        }
+        return nil, err
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if _, exists := c.entries[host]; !exists && len(c.entries) >= dnsCacheSize {
+        for name, existing := range c.entries {
+            if now.After(existing.expires) {
+                delete(c.entries, name)
+            }
+        }
+        for name := range c.entries {
+            if len(c.entries) < dnsCacheSize {
+                break
+            }
+            delete(c.entries, name)
+        }
+    }
+    c.entries[host] = dnsEntry{ips: ips, expires: now.Add(c.ttl)}
+    return ips, nil
+}
+
+func resolveIPs(ctx context.Context, host string) ([]net.IP, error) {
+    addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+    if err != nil {
+        return nil, err
+    }
+    ips := make([]net.IP, 0, len(addrs))
+    for _, addr := range addrs {
+        ips = append(ips, addr.IP)
+    }
+    return ips, nil
+}
+
+// dialer wraps dial so the host is resolved through the cache and each
+// address is tried in turn.
+func (c *dnsCache) dialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+    return func(ctx context.Context, network, addr string) (net.Conn, error) {
+        host, port, err := net.SplitHostPort(addr)
+        if err != nil {
+            return nil, err
+        }
+        ips, err := c.lookup(ctx, host)
+        if err != nil {
+            return nil, err
+        }
+
+        ctx = context.WithValue(ctx, dialHostKey{}, host)
+        err = &net.AddrError{Err: "no suitable address found", Addr: host}
+        for _, ip := range ips {
+            if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+                continue
+            }
+            var conn net.Conn
+            conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port))
+            if err == nil {
+                return conn, nil
+            }
+        }
+        return nil, err
+    }
+}
+
+// verifyConnection performs the standard certificate checks unless the host
+// is exempted. The server name is empty for IP literals; only exempted ones
+// get here, the rest are sent to the strict transport by RoundTrip.
+func verifyConnection(state tls.ConnectionState) error {
+    if state.ServerName == "" || skipVerify(state.ServerName) {
+        return nil
+    }
+    if len(state.PeerCertificates) == 0 {
+        return errors.New("tls: server presented no certificates")
+    }
+
+    opts := x509.VerifyOptions{DNSName: state.ServerName, Intermediates: x509.NewCertPool()}
+    for _, cert := range state.PeerCertificates[1:] {
+        opts.Intermediates.AddCert(cert)
+    }
+    _, err := state.PeerCertificates[0].Verify(opts)
+    return err
+}
+
+// skipVerify reports whether certificate checks are disabled for host. The
+// Telegram API, public or TELEGRAM_API_BASE, is always verified.
+func skipVerify(host string) bool {
+    host = strings.ToLower(host)
+    if host == "api.telegram.org" {
+        return false
+    }
+    if api, err := url.Parse(telegramAPI); err == nil && strings.EqualFold(api.Hostname(), host) {
+        return false
+    }
+    if insecureSkipAll {
+        return true
+    }
+    _, ok := insecureHosts[host]
+    return ok
+}
+
+func loadInsecureHosts() map[string]struct{} {
+    hosts := map[string]struct{}{}
+    for _, item := range parseBackendList(strings.TrimSpace(os.Getenv("INSECURE_HOSTS"))) {
+        host := strings.ToLower(item)
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        hosts[host] = struct{}{}
+    }
+    return hosts
+}
+
+func (t *resettableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if t.needsStrictTLS(req) {
+        return t.strictTransport().RoundTrip(req)
+    }
+    if network, ok := req.Context().Value(dialNetworkKey{}).(string); ok {
+        return t.pinnedTransport(network).RoundTrip(req)
+    }
+    return t.current.Load().RoundTrip(req)
+}
+
+// pinnedTransport returns the transport whose connections only use network
+// ("tcp4" or "tcp6"). Each family has its own pool so connections are never
+// shared across families.
+func (t *resettableTransport) pinnedTransport(network string) *http.Transport {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if transport, ok := t.pinned[network]; ok {
+        return transport
+    }
+
+    transport := newTransport(t.proxy, t.dns, t.guard)
+    dial, dialTLSConn := transport.DialContext, transport.DialTLSContext
+    transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+        return dial(ctx, network, addr)
+    }
+    if dialTLSConn != nil {
+        transport.DialTLSContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+            return dialTLSConn(ctx, network, addr)
+        }
+    }
+    if t.pinned == nil {
+        t.pinned = map[string]*http.Transport{}
+    }
+    t.pinned[network] = transport
+    return transport
+}
+
+// needsStrictTLS reports whether req goes through a proxy to an IP literal
+// that must be verified while certificate checks are relaxed for other hosts.
+// The TLS client reports no server name for IP literals, so verifyConnection
+// could not check the address against the certificate.
+func (t *resettableTransport) needsStrictTLS(req *http.Request) bool {
+    if !(insecureSkipAll || len(insecureHosts) > 0) || t.proxy == nil || req.URL.Scheme != "https" {
+        return false
+    }
+    host := req.URL.Hostname()
+    if net.ParseIP(host) == nil || skipVerify(host) {
+        return false
+    }
+    proxyURL, err := t.proxy(req)
+    return err == nil && proxyURL != nil
+}
+
+// strictTransport returns the transport that verifies every certificate
+// against the requested host, IP literals included.
+func (t *resettableTransport) strictTransport() *http.Transport {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.strict == nil {
+        t.strict = newTransport(t.proxy, t.dns, t.guard)
+        t.strict.TLSClientConfig = nil
+        t.strict.DialTLSContext = nil
+    }
+    return t.strict
+}
+
+// resetTransport resets client's transport when it is a resettableTransport;
+// other doers are left alone.
+func resetTransport(client doer) {
+    if c, ok := client.(*http.Client); ok {
+        if transport, ok := c.Transport.(*resettableTransport); ok {
+            transport.reset()
+        }
+    }
+}
+
+// reset swaps in a fresh transport so new requests stop reusing connections
+// that may be wedged.
+func (t *resettableTransport) reset() {
+    old := t.current.Swap(newTransport(t.proxy, t.dns, t.guard))
+    old.CloseIdleConnections()
+
+    t.mu.Lock()
+    for _, transport := range t.pinned {
+        transport.CloseIdleConnections()
+    }
+    t.pinned = nil
+    if t.strict != nil {
+        t.strict.CloseIdleConnections()
+        t.strict = nil
+    }
+    t.mu.Unlock()
+}
+
+// watchdogTimeout raises a WATCHDOG_TIMEOUT that a healthy idle long poll
+// would outlast to POLL_TIMEOUT_SECONDS plus REQUEST_TIMEOUT_SECONDS, so it
+// does not keep cancelling polls that are merely waiting. Zero disables it.
+func watchdogTimeout(configured time.Duration) time.Duration {
+    floor := pollTimeout + requestTimeout
+    if configured <= 0 || configured >= floor {
+        return configured
+    }
+    slog.Warn("WATCHDOG_TIMEOUT is shorter than a long poll, raising it", "configured", configured.String(), "timeout", floor.String())
+    return floor
+}
+
+func newWatchdog(timeout time.Duration) *watchdog {
+    return &watchdog{timeout: timeout, last: time.Now()}
+}
+
+func (w *watchdog) beat() {
+    w.mu.Lock()
+    w.last = time.Now()
+    w.mu.Unlock()
+}
+
+// extend pushes the next deadline d further out. The poll loop calls it
+// before waiting on purpose, such as for a 429 retry_after, so a long
+// requested wait is not mistaken for a stall.
+func (w *watchdog) extend(d time.Duration) {
+    w.mu.Lock()
+    w.last = time.Now().Add(d)
+    w.mu.Unlock()
+}
+
+func (w *watchdog) setCancel(cancel context.CancelFunc) {
+    w.mu.Lock()
+    w.cancel = cancel
+    w.mu.Unlock()
+}
+
+// alive reports whether a poll cycle completed recently. Unlike stalled it
+// also answers when the watchdog itself is disabled.
+func (w *watchdog) alive(now time.Time) bool {
+    timeout := w.timeout
+    if timeout <= 0 {
+        timeout = defaultWatchdog
+    }
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    return now.Sub(w.last) < timeout
+}
+
+func (w *watchdog) stalled(now time.Time) bool {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    return w.timeout > 0 && now.Sub(w.last) >= w.timeout
+}
+
+func (w *watchdog) run(ctx context.Context, client doer) {
+    ticker := time.NewTicker(w.timeout / 4)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            if !w.stalled(now) {
+                continue
+            }
+            slog.Warn("watchdog: no poll cycle completed in time, resetting HTTP transport", "timeout", w.timeout.String())
+            resetTransport(client)
+            w.mu.Lock()
+            if w.cancel != nil {
+                w.cancel()
+            }
+            w.last = now
+            w.mu.Unlock()
+        }
+    }
+}
+
+func getUpdates(ctx context.Context, client doer, token string, offset int) ([]update, error) {
+    allowed, _ := json.Marshal(allowedUpdates)
+    query := url.Values{}
+    query.Set("timeout", strconv.Itoa(int(pollTimeout.Seconds())))
+    query.Set("offset", strconv.Itoa(offset))
+    query.Set("allowed_updates", string(allowed))
+    endpoint := fmt.Sprintf("%s/bot%s/getUpdates?%s", telegramAPI, token, query.Encode())
+    ctx, cancel := context.WithTimeout(ctx, pollTimeout+5*time.Second)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return nil, &telegramError{method: "getUpdates", status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+    }
+
+    data, err := io.ReadAll(io.LimitReader(resp.Body, updatesBodyLimit))
+    if err != nil {
+        return nil, err
+    }
+
+    var decoded updateResponse
+    if err := json.Unmarshal(data, &decoded); err != nil {
+        return nil, err
+    }
+    if !decoded.Ok {
+        return nil, errTelegramNotOK
+    }
+
+    return decoded.Result, nil
+}
+
+// sendMessage delivers text to a chat. When SEND_TOKENS is configured the
+// send is spread across the extra bot tokens and fails over on 429; messages
+// with inline buttons always use the primary token. Once
+// every token is rate limited the send is retried after Telegram's
+// retry_after, up to sendRetries times and sendRetryMaxWait in total; the
+// wait ends early with ctx's error when ctx is done.
+func sendMessage(ctx context.Context, client doer, token string, chatID int64, text string) error {
+    return sendMessageWithMode(ctx, client, token, chatID, 0, 0, text, "", nil)
+}
+
+func sendMessageWithMode(ctx context.Context, client doer, token string, chatID int64, threadID, replyTo int, text, mode string, markup *inlineKeyboardMarkup) error {
+    if err := outboundLimiter.wait(ctx, chatID); err != nil {
+        return err
+    }
+
+    var waited time.Duration
+    for attempt := 0; ; attempt++ {
+        err := postMessageFailover(client, token, chatID, threadID, replyTo, text, mode, markup)
+        wait := telegramRetryAfter(err)
+        if wait <= 0 || attempt >= sendRetries || waited+wait > sendRetryMaxWait {
+            return err
+        }
+        slog.Warn("sendMessage rate limited, retrying", "chat_id", chatID, "retry_after", wait.String())
+        if !sleepContext(ctx, wait) {
+            return ctx.Err()
+        }
+        waited += wait
+    }
+}
+
+func postMessageFailover(client doer, token string, chatID int64, threadID, replyTo int, text, mode string, markup *inlineKeyboardMarkup) error {
+    // Inline buttons deliver their callbacks to the bot that sent the
+    // message, which only the primary token polls for.
+    tokens := []string{token}
+    if markup == nil {
+        tokens = sendTokens.order(token)
+    }
+    var err error
+    for i, candidate := range tokens {
+        err = postMessage(client, candidate, chatID, threadID, replyTo, text, mode, markup)
+        if !isRateLimited(err) || i == len(tokens)-1 {
+            return err
+        }
+        slog.Warn("sendMessage rate limited, failing over to next token", "chat_id", chatID)
+    }
+    return err
+}
+
+// startTyping shows the "typing" indicator in a chat until the returned stop
+// function is called. Telegram clears the action after about five seconds,
+// so it is re-sent periodically.
+func startTyping(ctx context.Context, client doer, token string, chatID int64, threadID int) func() {
+    ctx, cancel := context.WithCancel(ctx)
+    done := make(chan struct{})
+
+    go func() {
+        defer close(done)
+        ticker := time.NewTicker(typingInterval)
+        defer ticker.Stop()
+
+        for {
+            if err := sendChatAction(ctx, client, token, chatID, threadID, "typing"); err != nil && ctx.Err() == nil {
+                slog.Error("sendChatAction failed", "chat_id", chatID, "error", err)
+            }
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+            }
+        }
+    }()
+
+    return func() {
+        cancel()
+        <-done
+    }
+}
+
+func sendChatAction(ctx context.Context, client doer, token string, chatID int64, threadID int, action string) error {
+    payload := sendChatActionRequest{ChatID: chatID, MessageThreadID: threadID, Action: action}
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+
+    endpoint := fmt.Sprintf("%s/bot%s/sendChatAction", telegramAPI, token)
+    ctx, cancel := context.WithTimeout(ctx, telegramTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return &telegramError{method: "sendChatAction", status: resp.StatusCode, body: strings.TrimSpace(string(respBody))}
+    }
+
+    return nil
+}
+
+// sendDocument uploads data as a file attachment with an optional caption.
+func sendDocument(ctx context.Context, client doer, token string, chatID int64, threadID, replyTo int, name string, data []byte, caption string) error {
+    if err := outboundLimiter.wait(ctx, chatID); err != nil {
+        return err
+    }
+
+    var body bytes.Buffer
+    form := multipart.NewWriter(&body)
+    form.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+    if threadID != 0 {
+        form.WriteField("message_thread_id", strconv.Itoa(threadID))
+    }
+    if replyTo != 0 {
+        form.WriteField("reply_to_message_id", strconv.Itoa(replyTo))
+        form.WriteField("allow_sending_without_reply", "true")
+    }
+    if caption != "" {
+        form.WriteField("caption", caption)
+    }
+    part, err := form.CreateFormFile("document", name)
+    if err != nil {
+        return err
+    }
+    if _, err := part.Write(data); err != nil {
+        return err
+    }
+    if err := form.Close(); err != nil {
+        return err
+    }
+
+    endpoint := fmt.Sprintf("%s/bot%s/sendDocument", telegramAPI, token)
+    ctx, cancel := context.WithTimeout(context.Background(), telegramTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", form.FormDataContentType())
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return &telegramError{method: "sendDocument", status: resp.StatusCode, body: strings.TrimSpace(string(respBody))}
+    }
+
+    return nil
+}
+
+// verifyToken calls getMe, retrying transient failures with backoff. A token
+// Telegram rejects is returned immediately.
+func verifyToken(client doer, token string) (user, error) {
+    delay := pollBackoffBase
+    for attempt := 1; ; attempt++ {
+        me, err := getMe(client, token)
+        if err == nil || isInvalidToken(err) || attempt >= startupRetries {
+            return me, err
+        }
+        slog.Warn("getMe failed, retrying", "attempt", attempt, "retry_in", delay.String(), "error", err)
+        time.Sleep(delay)
+        delay *= 2
+    }
+}
+
+// isInvalidToken reports whether Telegram rejected the bot token. Malformed
+// tokens get 404 rather than 401.
+func isInvalidToken(err error) bool {
+    var apiErr *telegramError
+    if errors.As(err, &apiErr) {
+        return apiErr.status == http.StatusUnauthorized || apiErr.status == http.StatusNotFound
+    }
+    return errors.Is(err, errTelegramNotOK)
+}
+
+func getMe(client doer, token string) (user, error) {
+    endpoint := fmt.Sprintf("%s/bot%s/getMe", telegramAPI, token)
+    ctx, cancel := context.WithTimeout(context.Background(), telegramTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+    if err != nil {
+        return user{}, err
+    }
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return user{}, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return user{}, &telegramError{method: "getMe", status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+    }
+
+    var decoded getMeResponse
+    if err := json.NewDecoder(io.LimitReader(resp.Body, updatesBodyLimit)).Decode(&decoded); err != nil {
+        return user{}, err
+    }
+    if !decoded.Ok {
+        return user{}, errTelegramNotOK
+    }
+
+    return decoded.Result, nil
+}
+
+// sendMessageChunked sends text that may exceed Telegram's message limit as
+// several messages, splitting between backend blocks where possible. markup
+// is only attached when the text fits in one message, since a split report
+// cannot be edited in place.
+func sendMessageChunked(ctx context.Context, client doer, token string, chatID int64, threadID, replyTo int, text, mode string, markup *inlineKeyboardMarkup) error {
+    chunks := splitMessage(text, messageLimit)
+    if len(chunks) > 1 {
+        markup = nil
+    }
+    for i, chunk := range chunks {
+        // Only the first chunk quotes the command; the rest follow it.
+        if i > 0 {
+            replyTo = 0
+        }
+        err := sendMessageWithMode(ctx, client, token, chatID, threadID, replyTo, chunk, mode, markup)
+        if isTooLong(err) {
+            // Formatting can push a chunk past the limit after it was split.
+            // Send the rest of the report as a plain text file instead.
+            rest := strings.Join(chunks[i:], "\n\n")
+            if mode == markdownV2 {
+                rest = stripMarkdownV2(rest)
+            }
+            caption := ""
+            if i > 0 {
+                caption = tr("report_continued")
+            }
+            slog.Warn("message too long, sending as document", "chat_id", chatID)
+            return sendDocument(ctx, client, token, chatID, threadID, replyTo, textDocument, []byte(rest), caption)
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func splitMessage(text string, limit int) []string {
+    if messageLength(text) <= limit {
+        return []string{text}
+    }
+
+    var chunks []string
+    current := ""
+    for _, block := range strings.Split(text, "\n\n") {
+        for _, piece := range splitOversized(block, limit) {
+            if current == "" {
+                current = piece
+                continue
+            }
+            if messageLength(current)+2+messageLength(piece) <= limit {
+                current += "\n\n" + piece
+                continue
+            }
+            chunks = append(chunks, current)
+            current = piece
+        }
+    }
+    if current != "" {
+        chunks = append(chunks, current)
+    }
+    return chunks
+}
+
+// splitOversized breaks a single block that is over the limit on line
+// boundaries, falling back to a hard cut for a single overlong line.
+func splitOversized(block string, limit int) []string {
+    if messageLength(block) <= limit {
+        return []string{block}
+    }
+
+    var pieces []string
+    current := ""
+    for _, line := range strings.Split(block, "\n") {
+        for messageLength(line) > limit {
+            head, tail := cutMessage(line, limit)
+            if current != "" {
+                pieces = append(pieces, current)
+                current = ""
+            }
+            pieces = append(pieces, head)
+            line = tail
+        }
+        switch {
+        case current == "":
+            current = line
+        case messageLength(current)+1+messageLength(line) <= limit:
+            current += "\n" + line
+        default:
+            pieces = append(pieces, current)
+            current = line
+        }
+    }
+    if current != "" {
+        pieces = append(pieces, current)
+    }
+    return pieces
+}
+
+// messageLength counts UTF-16 code units, which is how Telegram measures
+// message length.
+func messageLength(text string) int {
+    n := 0
+    for _, r := range text {
+        n += utf16Len(r)
+    }
+    return n
+}
+
+func utf16Len(r rune) int {
+    if r >= 0x10000 {
+        return 2
+    }
+    return 1
+}
+
+func cutMessage(text string, limit int) (string, string) {
+    n := 0
+    for i, r := range text {
+        size := utf16Len(r)
+        if n+size > limit {
+            return text[:i], text[i:]
+        }
+        n += size
+    }
+    return text, ""
+}
+
+func postMessage(client doer, token string, chatID int64, threadID, replyTo int, text, mode string, markup *inlineKeyboardMarkup) error {
+    // If the command message was deleted in the meantime, Telegram still
+    // delivers the reply as a standalone message instead of failing.
+    payload := sendMessageRequest{
+        ChatID:                chatID,
+        MessageThreadID:       threadID,
+        Text:                  text,
+        ParseMode:             mode,
+        DisableWebPagePreview: true,
+        ReplyToMessageID:      replyTo,
+        AllowWithoutReply:     replyTo != 0,
+        ReplyMarkup:           markup,
+    }
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+
+    endpoint := fmt.Sprintf("%s/bot%s/sendMessage", telegramAPI, token)
+    ctx, cancel := context.WithTimeout(context.Background(), telegramTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return &telegramError{method: "sendMessage", status: resp.StatusCode, body: strings.TrimSpace(string(respBody))}
+    }
+
+    return nil
+}
+
+// editMessageText replaces the text and inline keyboard of a sent message.
+func editMessageText(ctx context.Context, client doer, token string, chatID int64, messageID int, text, mode string, markup *inlineKeyboardMarkup) error {
+    if err := outboundLimiter.wait(ctx, chatID); err != nil {
+        return err
+    }
+    return postTelegram(client, token, "editMessageText", editMessageTextRequest{
+        ChatID:                chatID,
+        MessageID:             messageID,
+        Text:                  text,
+        ParseMode:             mode,
+        DisableWebPagePreview: true,
+        ReplyMarkup:           markup,
+    })
+}
+
+// answerCallback acknowledges a callback query, optionally showing text as a
+// toast. Failures are only logged: the client just keeps its spinner longer.
+func answerCallback(client doer, token, id, text string) {
+    err := postTelegram(client, token, "answerCallbackQuery", answerCallbackRequest{CallbackQueryID: id, Text: text})
+    if err != nil {
+        slog.Error("answerCallbackQuery failed", "error", err)
+    }
+}
+
+// postTelegram calls a Bot API method with a JSON payload and discards the
+// result.
+func postTelegram(client doer, token, method string, payload any) error {
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+
+    endpoint := fmt.Sprintf("%s/bot%s/%s", telegramAPI, token, method)
+    ctx, cancel := context.WithTimeout(context.Background(), telegramTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return &telegramError{method: method, status: resp.StatusCode, body: strings.TrimSpace(string(respBody))}
+    }
+
+    return nil
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+    return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns how long the caller must wait for it.
+// A now older than the previous reservation, from a caller that raced for
+// the lock, refills nothing.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if now.After(l.last) {
+        l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+        l.last = now
+    }
+    l.tokens--
+    if l.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) idle(now time.Time) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.tokens+now.Sub(l.last).Seconds()*l.rate >= l.burst
+}
+
+func newSendLimiter(perSecond, chatPerMinute int) *sendLimiter {
+    return &sendLimiter{
+        global:   newRateLimiter(float64(perSecond), perSecond),
+        perChat:  map[int64]*rateLimiter{},
+        chatRate: float64(chatPerMinute) / 60,
+    }
+}
+
+func (l *sendLimiter) chatLimiter(chatID int64, now time.Time) *rateLimiter {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    limiter, ok := l.perChat[chatID]
+    if ok {
+        return limiter
+    }
+    if len(l.perChat) >= limiterIdleChats {
+        for id, existing := range l.perChat {
+            if existing.idle(now) {
+                delete(l.perChat, id)
+            }
+        }
+    }
+    burst := int(math.Max(1, l.chatRate*60))
+    limiter = newRateLimiter(l.chatRate, burst)
+    l.perChat[chatID] = limiter
+    return limiter
+}
+
+// wait blocks until both the per-chat and global budgets allow a send.
+func (l *sendLimiter) wait(ctx context.Context, chatID int64) error {
+    now := time.Now()
+    delay := l.chatLimiter(chatID, now).reserve(now)
+    if global := l.global.reserve(now); global > delay {
+        delay = global
+    }
+    if delay <= 0 {
+        return nil
+    }
+    if !sleepContext(ctx, delay) {
+        return ctx.Err()
+    }
+    return nil
+}
+
+func (e *telegramError) Error() string {
+    return fmt.Sprintf("%s status %d: %s", e.method, e.status, e.body)
+}
+
+// commandName maps the aliases of a command to one canonical name.
+func commandName(text string) string {
+    if isBackendCommand(text) {
+        return "/backend"
+    }
+    command, _ := splitCommand(text)
+    return command
+}
+
+func isBackendCommand(text string) bool {
+    command, _ := splitCommand(text)
+    return command == "/backend" || command == "/后端状态" || command == "后端状态" || commandAliases[command]
+}
+
+// loadCommandAliases reads extra triggers for the status command from
+// COMMAND_ALIASES. They are matched exactly, like the built-in ones.
+func loadCommandAliases() map[string]bool {
+    aliases := map[string]bool{}
+    for _, alias := range strings.Split(os.Getenv("COMMAND_ALIASES"), ",") {
+        if alias = strings.TrimSpace(alias); alias == "" {
+            continue
+        }
+        if strings.ContainsAny(alias, " \t\n") {
+            slog.Warn("command alias must be a single word, ignoring", "value", alias)
+            continue
+        }
+        aliases[alias] = true
+    }
+    return aliases
+}
+
+func buildBackendReply(ctx context.Context, client doer, args []string) string {
+    if filter, ok := statusFilter(args); ok {
+        return buildStatusMessage(ctx, client, filter)
+    }
+    if len(args) > 1 {
+        return mdText("用法: /backend [序号|地址]，例如 /backend 3 或 /backend https://example.org")
+    }
+
+    if index, err := strconv.Atoi(args[0]); err == nil {
+        targets, _ := loadBackendTargets()
+        if index < 1 || index > len(targets) {
+            return mdText(fmt.Sprintf("索引超出范围，当前共有 %d 个后端。", len(targets)))
+        }
+        target := targets[index-1]
+        return buildSingleBackendMessage(index, target, fetchBackendInfo(ctx, client, target))
+    }
+
+    target, err := parseAdhocTarget(args[0])
+    if err != nil {
+        return mdText(fmt.Sprintf("无效的后端地址: %v", err))
+    }
+
+    result := fetchBackendInfo(ctx, client, target)
+    return buildSingleBackendMessage(1, target, result)
+}
+
+func parseAdhocTarget(raw string) (backendTarget, error) {
+    display, urlValue := normalizeBackendTarget(raw, normalizePath)
+    if display == "" || urlValue == "" {
+        return backendTarget{}, errors.New("无法解析")
+    }
+
+    parsed, err := url.Parse(urlValue)
+    if err != nil {
+        return backendTarget{}, errors.New("无法解析")
+    }
+    if parsed.Scheme != "http" && parsed.Scheme != "https" {
+        return backendTarget{}, fmt.Errorf("不支持的协议 %s", parsed.Scheme)
+    }
+    host := parsed.Hostname()
+    if host == "" || (net.ParseIP(host) == nil && !hostnamePattern.MatchString(host)) {
+        return backendTarget{}, errors.New("主机名不合法")
+    }
+
+    return backendTarget{display: display, url: urlValue, weight: 1}, nil
+}
+
+func buildSingleBackendMessage(index int, target backendTarget, result backendResult) string {
+    return mdBold(tr("single_title")) + "\n\n" + formatBackendBlock(index, target.display, result)
+}
+
+func splitCommand(text string) (string, []string) {
+    fields := strings.Fields(text)
+    if len(fields) == 0 {
+        return "", nil
+    }
+    return stripBotMention(fields[0]), fields[1:]
+}
+
+// stripBotMention removes a trailing "@<username>" that Telegram appends to
+// commands in groups, but only when it names this bot.
+func stripBotMention(command string) string {
+    at := strings.LastIndex(command, "@")
+    if at <= 0 || botUsername == "" {
+        return command
+    }
+    if strings.EqualFold(command[at+1:], botUsername) {
+        return command[:at]
+    }
+    return command
+}
+
+func buildJitterMessage(ctx context.Context, client doer, args []string) string {
+    usage := fmt.Sprintf("用法: /jitter <序号> [次数]，次数范围 1-%d，默认 %d", maxJitterRuns, defaultJitterRuns)
+    if len(args) == 0 || len(args) > 2 {
+        return usage
+    }
+
+    index, err := strconv.Atoi(args[0])
+    if err != nil {
+        return usage
+    }
+    runs := defaultJitterRuns
+    if len(args) == 2 {
+        runs, err = strconv.Atoi(args[1])
+        if err != nil || runs < 1 || runs > maxJitterRuns {
+            return usage
+        }
+    }
+
+    targets, _ := loadBackendTargets()
+    if index < 1 || index > len(targets) {
+        return fmt.Sprintf("序号超出范围，当前共有 %d 个后端。", len(targets))
+    }
+    target := targets[index-1]
+
+    latencies := make([]time.Duration, 0, runs)
+    for i := 0; i < runs; i++ {
+        if i > 0 && !sleepContext(ctx, jitterSpacing) {
+            break
+        }
+        result := fetchBackendInfo(ctx, client, target)
+        if result.ok {
+            latencies = append(latencies, result.latency)
+        }
+    }
+
+    stats := computeJitterStats(latencies, runs)
+    lines := []string{
+        fmt.Sprintf("抖动测试 [%d] %s", index, target.display),
+        fmt.Sprintf("成功率: %d/%d (%.0f%%)", stats.success, stats.total, float64(stats.success)*100/float64(stats.total)),
+    }
+    if stats.success > 0 {
+        lines = append(lines,
+            fmt.Sprintf("最小: %dms", stats.min.Milliseconds()),
+            fmt.Sprintf("最大: %dms", stats.max.Milliseconds()),
+            fmt.Sprintf("平均: %dms", stats.avg.Milliseconds()),
+            fmt.Sprintf("标准差: %dms", stats.stddev.Milliseconds()),
+        )
+    }
+
+    return strings.Join(lines, "\n")
+}
+
+func buildConvertLatencyMessage(ctx context.Context, client doer, args []string) string {
+    if deepProbeURL == "" {
+        return "未配置 DEEP_PROBE_URL，无法测试转换延迟。"
+    }
+    if len(args) != 1 {
+        return "用法: /convlat <序号>"
+    }
+    index, err := strconv.Atoi(args[0])
+    if err != nil {
+        return "用法: /convlat <序号>"
+    }
+
+    targets, _ := loadBackendTargets()
+    if index < 1 || index > len(targets) {
+        return fmt.Sprintf("序号超出范围，当前共有 %d 个后端。", len(targets))
+    }
+    target := targets[index-1]
+
+    versionResult := fetchBackendInfo(ctx, client, target)
+    convertLatency, err := measureConversion(ctx, client, target.url)
+
+    lines := []string{fmt.Sprintf("转换延迟 [%d] %s", index, target.display)}
+    if versionResult.ok {
+        lines = append(lines, fmt.Sprintf("版本接口: %dms", versionResult.latency.Milliseconds()))
+    } else {
+        lines = append(lines, fmt.Sprintf("版本接口: 失败 (%s)", versionResult.err))
+    }
+    if err != nil {
+        lines = append(lines, fmt.Sprintf("订阅转换: 失败 (%v)", err))
+    } else {
+        lines = append(lines, fmt.Sprintf("订阅转换: %dms", convertLatency.Milliseconds()))
+    }
+
+    return strings.Join(lines, "\n")
+}
+
+// buildConvertURL expands DEEP_PROBE_URL for a backend. "{base}" is replaced
+// with the backend origin; a template without it is treated as a path on it.
+func buildConvertURL(template, targetURL string) (string, error) {
+    parsed, err := url.Parse(targetURL)
+    if err != nil {
+        return "", err
+    }
+    base := parsed.Scheme + "://" + parsed.Host
+
+    if strings.Contains(template, "{base}") {
+        return strings.ReplaceAll(template, "{base}", base), nil
+    }
+    if !strings.HasPrefix(template, "/") {
+        template = "/" + template
+    }
+    return base + template, nil
+}
+
+func measureConversion(ctx context.Context, client doer, targetURL string) (time.Duration, error) {
+    convertURL, err := buildConvertURL(deepProbeURL, targetURL)
+    if err != nil {
+        return 0, err
+    }
+    if err := checkTargetAllowed(ctx, convertURL); err != nil {
+        return 0, errors.New(classifyError(err))
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, convertTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, convertURL, nil)
+    if err != nil {
+        return 0, errors.New("request_error")
+    }
+
+    start := time.Now()
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, errors.New(classifyError(err))
+    }
+    defer resp.Body.Close()
+
+    if _, err := io.Copy(io.Discard, io.LimitReader(resp.Body, convertBodyLimit)); err != nil {
+        return 0, errors.New("read_error")
+    }
+    latency := time.Since(start)
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return latency, fmt.Errorf("HTTP %d", resp.StatusCode)
+    }
+    return latency, nil
+}
+
+// buildHeadersMessage returns a MarkdownV2 reply with the target's response
+// headers in a code block, so values with markup characters show verbatim.
+func buildHeadersMessage(ctx context.Context, client doer, args []string) string {
+    if len(args) != 1 {
+        return escapeMarkdownV2("用法: /headers <序号>")
+    }
+    index, err := strconv.Atoi(args[0])
+    if err != nil {
+        return escapeMarkdownV2("用法: /headers <序号>")
+    }
+
+    targets, _ := loadBackendTargets()
+    if index < 1 || index > len(targets) {
+        return escapeMarkdownV2(fmt.Sprintf("序号超出范围，当前共有 %d 个后端。", len(targets)))
+    }
+    target := targets[index-1]
+
+    result := fetchBackendInfo(ctx, client, target)
+    if result.headers == nil {
+        return escapeMarkdownV2(fmt.Sprintf("[%d] %s\n无法获取响应头: %s", index, target.display, result.err))
+    }
+
+    title := escapeMarkdownV2(fmt.Sprintf("[%d] %s\nHTTP %d", index, target.display, result.status))
+    return title + "\n\n```\n" + markdownCodeEscaper.Replace(formatHeaders(result.headers)) + "\n```"
+}
+
+// buildConsistencyMessage checks every configured backend and reports whether
+// the subconverter ones all run the same version.
+func buildConsistencyMessage(ctx context.Context, client doer) string {
+    targets, _ := loadBackendTargets()
+    results := checkBackends(ctx, client, targets)
+
+    groups := groupByVersion(results)
+    if len(groups) == 0 {
+        return "没有可比较版本的在线后端。"
+    }
+    versions := sortedVersions(groups)
+    if len(versions) == 1 {
+        return fmt.Sprintf("✅ 版本一致 (%s)", versions[0])
+    }
+
+    lines := []string{fmt.Sprintf("⚠️ 版本不一致，共 %d 个版本:", len(versions))}
+    for _, version := range versions {
+        lines = append(lines, "", version)
+        for _, idx := range groups[version] {
+            lines = append(lines, fmt.Sprintf("  [%d] %s", idx+1, targets[idx].display))
+        }
+    }
+    return strings.Join(lines, "\n")
+}
+
+// buildStatsMessage reports each configured backend's uptime over the window
+// recorded in STATS_FILE.
+func buildStatsMessage() string {
+    if uptimeStore == nil {
+        return "未启用历史统计，请设置 STATS_FILE。"
+    }
+    targets, _ := loadBackendTargets()
+    since, entries := uptimeStore.snapshot(targets)
+
+    lines := []string{fmt.Sprintf("📈 历史可用率 (自 %s)", since.In(displayLocation).Format("2006-01-02 15:04"))}
+    for i, target := range targets {
+        entry := entries[i]
+        if entry.Checks == 0 {
+            lines = append(lines, fmt.Sprintf("[%d] %s: 暂无数据", i+1, target.display))
+            continue
+        }
+        uptime := float64(entry.Checks-entry.Failures) / float64(entry.Checks) * 100
+        lines = append(lines, fmt.Sprintf("[%d] %s: %.2f%% (%d 次检测，%d 次失败)", i+1, target.display, uptime, entry.Checks, entry.Failures))
+    }
+    return strings.Join(lines, "\n")
+}
+
+// buildPingMessage times a getMe call, checking the bot's own connection to
+// Telegram without touching any backend.
+func buildPingMessage(client doer, token string) string {
+    start := time.Now()
+    if _, err := getMe(client, token); err != nil {
+        // Transport errors quote the request URL, which contains the token.
+        return "⚠️ 无法连接 Telegram: " + strings.ReplaceAll(err.Error(), token, "***")
+    }
+    return fmt.Sprintf("🏓 pong (Telegram 往返 %dms)", time.Since(start).Milliseconds())
+}
+
+func buildVersionMessage() string {
+    return strings.Join([]string{
+        "tg-backend-bot " + botVersion,
+        "提交: " + botCommit,
+        "构建日期: " + botBuildDate,
+        "Go: " + runtime.Version(),
+    }, "\n")
+}
+
+// groupByVersion maps each version reported by an online backend to the
+// indexes of the results running it.
+func groupByVersion(results []backendResult) map[string][]int {
+    groups := make(map[string][]int)
+    for i, result := range results {
+        if result.ok && result.info.version != "" {
+            groups[result.info.version] = append(groups[result.info.version], i)
+        }
+    }
+    return groups
+}
+
+// sortedVersions orders versions by how many backends run them, most first.
+func sortedVersions(groups map[string][]int) []string {
+    versions := make([]string, 0, len(groups))
+    for version := range groups {
+        versions = append(versions, version)
+    }
+    sort.Slice(versions, func(i, j int) bool {
+        if len(groups[versions[i]]) != len(groups[versions[j]]) {
+            return len(groups[versions[i]]) > len(groups[versions[j]])
+        }
+        return versions[i] < versions[j]
+    })
+    return versions
+}
+
+// formatLatencySummary returns the average and slowest latency over online
+// backends, or "" when none has a measured latency.
+func formatLatencySummary(targets []backendTarget, results []backendResult) string {
+    var total time.Duration
+    count, slowest := 0, -1
+    for i, result := range results {
+        if !result.ok || result.latency <= 0 {
+            continue
+        }
+        total += result.latency
+        count++
+        if slowest < 0 || result.latency > results[slowest].latency {
+            slowest = i
+        }
+    }
+    if count == 0 {
+        return ""
+    }
+    average := total / time.Duration(count)
+    return trf("latency_summary", average.Milliseconds(), results[slowest].latency.Milliseconds(), targets[slowest].display)
+}
+
+func formatVersionSummary(results []backendResult) string {
+    groups := groupByVersion(results)
+    if len(groups) == 0 {
+        return ""
+    }
+    versions := sortedVersions(groups)
+    if len(versions) == 1 {
+        return trf("version_match", versions[0])
+    }
+
+    lines := []string{tr("version_mismatch")}
+    for _, version := range versions {
+        lines = append(lines, trf("version_count", version, len(groups[version])))
+    }
+    return strings.Join(lines, "\n")
+}
+
+func formatHeaders(headers http.Header) string {
+    names := make([]string, 0, len(headers))
+    for name := range headers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    lines := make([]string, 0, len(names))
+    for _, name := range names {
+        for _, value := range headers[name] {
+            if isSensitiveHeader(name) {
+                value = "***"
+            }
+            lines = append(lines, fmt.Sprintf("%s: %s", name, value))
+        }
+    }
+    return strings.Join(lines, "\n")
+}
+
+func isSensitiveHeader(name string) bool {
+    switch http.CanonicalHeaderKey(name) {
+    case "Set-Cookie", "Cookie", "Authorization", "Proxy-Authorization", "Www-Authenticate", "Proxy-Authenticate":
+        return true
+    }
+    lower := strings.ToLower(name)
+    return strings.Contains(lower, "token") || strings.Contains(lower, "secret") || strings.Contains(lower, "api-key")
+}
+
+func isAdmin(from *user) bool {
+    if from == nil {
+        return false
+    }
+    _, ok := adminIDs[from.ID]
+    return ok
+}
+
+func computeJitterStats(latencies []time.Duration, total int) jitterStats {
+    stats := jitterStats{total: total, success: len(latencies)}
+    if len(latencies) == 0 {
+        return stats
+    }
+
+    stats.min = latencies[0]
+    stats.max = latencies[0]
+    var sum time.Duration
+    for _, latency := range latencies {
+        if latency < stats.min {
+            stats.min = latency
+        }
+        if latency > stats.max {
+            stats.max = latency
+        }
+        sum += latency
+    }
+    stats.avg = sum / time.Duration(len(latencies))
+
+    var variance float64
+    for _, latency := range latencies {
+        diff := float64(latency - stats.avg)
+        variance += diff * diff
+    }
+    variance /= float64(len(latencies))
+    stats.stddev = time.Duration(math.Sqrt(variance))
+
+    return stats
+}
+
+// buildStatusMessage renders the status of all configured backends. A filter
+// of "online" or "offline" limits the blocks shown; the title always counts
+// every backend.
+func buildStatusMessage(ctx context.Context, client doer, filter string) string {
+	targets, truncated := loadBackendTargets()
+	if len(targets) == 0 {
+		return mdText(tr("no_backends"))
+	}
+
+    results, checked, cached := statusResults(ctx, client, targets)
+
+    blocks := make([]string, 0, len(results))
+	onlineCount, maintenanceCount := 0, 0
+
+	for _, result := range results {
+		if result.ok {
+			onlineCount++
+		} else if result.err == "maintenance" {
+			maintenanceCount++
+		}
+	}
+	groups := groupTargets(targets, sortOrder(results, sortMode))
+	tagged := len(groups) > 1 || groups[0].name != ""
+	for _, group := range groups {
+		var members []string
+		online := 0
+		for _, i := range group.indexes {
+			if results[i].ok {
+				online++
+			}
+			if (filter == "online" && !results[i].ok) || (filter == "offline" && results[i].ok) {
+				continue
+			}
+			members = append(members, formatBackendBlock(i+1, targets[i].display, results[i]))
+		}
+		if len(members) == 0 {
+			continue
+		}
+		if tagged {
+			blocks = append(blocks, mdBold(trf("group_header", groupIcon(group.name), groupLabel(group.name), online, len(group.indexes)-online)))
+		}
+		blocks = append(blocks, members...)
+	}
+	if len(blocks) == 0 && filter == "offline" {
+		blocks = append(blocks, mdText(tr("all_online")))
+	} else if len(blocks) == 0 && filter == "online" {
+		blocks = append(blocks, mdText(tr("none_online")))
+	}
+
+	offlineCount := len(results) - onlineCount - maintenanceCount
+	availability := weightedAvailability(targets, results)
+	title := healthIndicator(availability) + " " + trf("title", len(results), onlineCount, offlineCount)
+	if maintenanceCount > 0 {
+		title = healthIndicator(availability) + " " + trf("title_maintenance", len(results), onlineCount, maintenanceCount, offlineCount)
+	}
+	if truncated {
+		title += trf("truncated", maxBackends)
+	}
+	if cached {
+		title += trf("cached", int(time.Since(checked).Seconds()))
+	}
+	header := mdBold(title)
+	if summary := formatLatencySummary(targets, results); summary != "" {
+		header += "\n" + mdText(summary)
+	}
+
+	footer := trf("availability", availability)
+	if minOnlinePercent > 0 && availability < minOnlinePercent {
+		footer += trf("below_threshold", minOnlinePercent)
+	}
+
+	if summary := formatVersionSummary(results); summary != "" {
+		footer = summary + "\n" + footer
+	}
+	footer += "\n" + trf("uptime", formatUptime(time.Since(processStart)), checked.In(displayLocation).Format("15:04:05"))
+
+	return header + "\n\n" + strings.Join(blocks, "\n\n") + "\n\n" + mdText(footer)
+}
+
+// statusResults returns the check results for targets, served from the
+// status cache while they are fresh.
+func statusResults(ctx context.Context, client doer, targets []backendTarget) ([]backendResult, time.Time, bool) {
+    key := targetsKey(targets)
+    results, checked, cached := resultsCache.get(key, cacheTTL())
+    if !cached {
+        results, checked = checkFlights.do(ctx, key, func() ([]backendResult, time.Time) {
+            // A flight that finished just before this one started has
+            // already filled the cache.
+            if results, checked, ok := resultsCache.get(key, cacheTTL()); ok {
+                return results, checked
+            }
+            // The shared run must not be cut short when the caller that
+            // started it gives up, so it follows the process context and
+            // only a shutdown aborts it.
+            results := checkBackends(processCtx, client, targets)
+            checked := time.Now()
+            resultsCache.set(key, results, checked)
+            return results, checked
+        })
+        if results == nil {
+            results = checkBackends(ctx, client, targets)
+            checked = time.Now()
+        }
+    }
+    return results, checked, cached
+}
+
+// do runs check for key unless a run for the same key is already in flight,
+// in which case it waits for that run and returns its results. A caller whose
+// ctx ends while waiting gets nil results.
+func (g *checkGroup) do(ctx context.Context, key string, check func() ([]backendResult, time.Time)) ([]backendResult, time.Time) {
+    g.mu.Lock()
+    call, ok := g.calls[key]
+    if !ok {
+        call = &checkCall{done: make(chan struct{})}
+        g.calls[key] = call
+        g.mu.Unlock()
+
+        call.results, call.checked = check()
+        g.mu.Lock()
+        delete(g.calls, key)
+        g.mu.Unlock()
+        close(call.done)
+    } else {
+        g.mu.Unlock()
+        select {
+        case <-call.done:
+        case <-ctx.Done():
+            return nil, time.Time{}
+        }
+    }
+
+    results := make([]backendResult, len(call.results))
+    copy(results, call.results)
+    return results, call.checked
+}
+
+// buildStatusJSON serializes the current status as a snapshot. It is returned
+// as a MarkdownV2 code block when it fits in one message, and as a document
+// to attach otherwise.
+func buildStatusJSON(ctx context.Context, client doer) (string, []byte) {
+    targets, _ := loadBackendTargets()
+    results, checked, _ := statusResults(ctx, client, targets)
+
+    data, err := json.MarshalIndent(newSnapshot(targets, results, checked), "", "  ")
+    if err != nil {
+        return mdText(fmt.Sprintf("序列化失败: %v", err)), nil
+    }
+
+    block := "```json\n" + markdownCodeEscaper.Replace(string(data)) + "\n```"
+    if messageLength(block) > messageLimit {
+        return "", data
+    }
+    return block, nil
+}
+
+// targetGroup is a run of result indexes shown under one tag header.
+type targetGroup struct {
+    name    string
+    indexes []int
+}
+
+// groupTargets splits order into groups by tag, in order of each tag's
+// first appearance, with untagged backends last. Without any tags it
+// returns a single unnamed group so the report stays flat.
+func groupTargets(targets []backendTarget, order []int) []targetGroup {
+    var groups []targetGroup
+    position := map[string]int{}
+    var untagged []int
+    for _, i := range order {
+        name := targets[i].group
+        if name == "" {
+            untagged = append(untagged, i)
+            continue
+        }
+        pos, ok := position[name]
+        if !ok {
+            pos = len(groups)
+            position[name] = pos
+            groups = append(groups, targetGroup{name: name})
+        }
+        groups[pos].indexes = append(groups[pos].indexes, i)
+    }
+    if len(untagged) > 0 {
+        groups = append(groups, targetGroup{indexes: untagged})
+    }
+    return groups
+}
+
+func groupLabel(name string) string {
+    if name == "" {
+        return tr("group_default")
+    }
+    return name
+}
+
+// groupIcons maps well-known region tags to a globe facing that region.
+var groupIcons = map[string]string{
+    "us":      "🌎",
+    "na":      "🌎",
+    "america": "🌎",
+    "eu":      "🌍",
+    "europe":  "🌍",
+    "africa":  "🌍",
+    "asia":    "🌏",
+    "jp":      "🌏",
+    "hk":      "🌏",
+    "sg":      "🌏",
+}
+
+// groupIcon returns the header icon for a tag group, 🌐 for unknown tags.
+func groupIcon(name string) string {
+    if icon, ok := groupIcons[strings.ToLower(name)]; ok {
+        return icon
+    }
+    return "🌐"
+}
+
+// sortOrder returns result indices in display order. Indices always refer to
+// the configured position so the "[n]" labels stay stable.
+func sortOrder(results []backendResult, mode string) []int {
+    order := make([]int, len(results))
+    for i := range order {
+        order[i] = i
+    }
+
+    switch mode {
+    case "status":
+        sort.SliceStable(order, func(a, b int) bool {
+            return !results[order[a]].ok && results[order[b]].ok
+        })
+    case "latency":
+        sort.SliceStable(order, func(a, b int) bool {
+            left, right := results[order[a]], results[order[b]]
+            if left.ok != right.ok {
+                return left.ok
+            }
+            return left.ok && left.latency < right.latency
+        })
+    }
+
+    return order
+}
+
+// weightedAvailability returns the weighted share of online backends in
+// percent. When every weight is 0 the backends count equally.
+func weightedAvailability(targets []backendTarget, results []backendResult) float64 {
+    total := 0
+    online := 0
+    for i, result := range results {
+        weight := targets[i].weight
+        total += weight
+        if result.ok {
+            online += weight
+        }
+    }
+    if total == 0 {
+        for _, result := range results {
+            total++
+            if result.ok {
+                online++
+            }
+        }
+    }
+    if total == 0 {
+        return 0
+    }
+    return float64(online) * 100 / float64(total)
+}
+
+func healthIndicator(availability float64) string {
+    switch {
+    case availability >= 100:
+        return "🟢"
+    case availability <= 0 || availability < minOnlinePercent:
+        return "🔴"
+    default:
+        return "🟡"
+    }
+}
+
+func targetsKey(targets []backendTarget) string {
+    urls := make([]string, 0, len(targets))
+    for _, target := range targets {
+        urls = append(urls, target.url)
+    }
+    return strings.Join(urls, "\n")
+}
+
+func (c *statusCache) get(key string, ttl time.Duration) ([]backendResult, time.Time, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if ttl <= 0 || c.results == nil {
+        return nil, time.Time{}, false
+    }
+    if c.key != key {
+        c.key = ""
+        c.results = nil
+        return nil, time.Time{}, false
+    }
+    if time.Since(c.checked) >= ttl {
+        return nil, time.Time{}, false
+    }
+
+    results := make([]backendResult, len(c.results))
+    copy(results, c.results)
+    return results, c.checked, true
+}
+
+func (c *statusCache) set(key string, results []backendResult, checked time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.key = key
+    c.results = make([]backendResult, len(results))
+    copy(c.results, results)
+    c.checked = checked
+}
+
+func (c *statusCache) checkedAt(key string) time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.key != key || c.results == nil {
+        return time.Time{}
+    }
+    return c.checked
+}
+
+// runCacheRefresher re-probes the configured backends shortly before the
+// cached results expire so commands are served from a warm cache.
+func runCacheRefresher(ctx context.Context, client doer) {
+    for {
+        targets, _ := loadBackendTargets()
+        key := targetsKey(targets)
+        delay := nextRefreshDelay(resultsCache.checkedAt(key), statusCacheTTL, time.Now())
+        if delay > 0 {
+            if !sleepContext(ctx, delay) {
+                return
+            }
+            // Someone else may have refreshed the cache while we slept.
+            continue
+        }
+        if len(targets) == 0 {
+            if !sleepContext(ctx, statusCacheTTL) {
+                return
+            }
+            continue
+        }
+
+        // Sharing the flight with commands keeps a status request that
+        // arrives mid-refresh from starting a second round of probes.
+        checkFlights.do(ctx, key, func() ([]backendResult, time.Time) {
+            results := checkBackends(ctx, client, targets)
+            checked := time.Now()
+            if ctx.Err() == nil {
+                resultsCache.set(key, results, checked)
+            }
+            return results, checked
+        })
+        if ctx.Err() != nil {
+            return
+        }
+    }
+}
+
+func nextRefreshDelay(checked time.Time, ttl time.Duration, now time.Time) time.Duration {
+    if checked.IsZero() {
+        return 0
+    }
+
+    margin := ttl / 5
+    if margin < time.Second {
+        margin = time.Second
+    }
+    if margin > ttl/2 {
+        margin = ttl / 2
+    }
+
+    delay := checked.Add(ttl - margin).Sub(now)
+    if delay < 0 {
+        return 0
+    }
+    return delay
+}
+
+// cacheTTL is how long cached results may be served. With background polling
+// enabled the latest snapshot stays valid until the next poll is overdue.
+func cacheTTL() time.Duration {
+    if pollInterval > 0 && 2*pollInterval > statusCacheTTL {
+        return 2 * pollInterval
+    }
+    return statusCacheTTL
+}
+
+// runBackgroundPoller probes the configured backends every POLL_INTERVAL and
+// stores the results in the shared cache. Runs never overlap: the next run
+// is only scheduled after the current check completes. With POLL_JITTER each
+// interval varies by up to 10% so instances do not probe in lockstep.
+func runBackgroundPoller(ctx context.Context, client doer) {
+    for {
+        started := time.Now()
+        targets, _ := loadBackendTargets()
+        if len(targets) > 0 {
+            results := checkBackends(ctx, client, targets)
+            if ctx.Err() != nil {
+                return
+            }
+            resultsCache.set(targetsKey(targets), results, time.Now())
+            for _, a := range transitions.observe(targets, results, time.Now()) {
+                dispatchAlert(ctx, alertNotifiers, a)
+            }
+            if uptimeStore != nil {
+                uptimeStore.record(targets, results)
+            }
+        }
+
+        if !sleepContext(ctx, time.Until(started.Add(jitterInterval(pollInterval)))) {
+            return
+        }
+    }
+}
+
+// jitterInterval spreads d randomly by ±10% when POLL_JITTER is enabled.
+func jitterInterval(d time.Duration) time.Duration {
+    spread := int64(d / 10)
+    if !pollJitter || spread <= 0 {
+        return d
+    }
+    return d + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// checkBackends probes targets concurrently. Probes still waiting or running
+// when ctx ends, or when BATCH_TIMEOUT_SECONDS runs out, are reported as
+// "cancelled".
+func checkBackends(ctx context.Context, client doer, targets []backendTarget) []backendResult {
+    results := make([]backendResult, len(targets))
+    sem := make(chan struct{}, maxConcurrency)
+    var wg sync.WaitGroup
+
+    batchCtx, cancel := ctx, context.CancelFunc(func() {})
+    if batchTimeout > 0 {
+        batchCtx, cancel = context.WithTimeout(ctx, batchTimeout)
+    }
+    defer cancel()
+
+    for i, target := range targets {
+        wg.Add(1)
+        go func(idx int, target backendTarget) {
+            defer wg.Done()
+            if !breakers.allow(target.url, time.Now()) {
+                results[idx] = backendResult{ok: false, err: "breaker_open"}
+                return
+            }
+            // Staggering the starts keeps backends behind shared
+            // infrastructure from seeing every probe at once.
+            if pollJitter && !sleepContext(batchCtx, time.Duration(rand.Int63n(int64(probeJitterMax)))) {
+                breakers.cancel(target.url)
+                results[idx] = backendResult{ok: false, err: "cancelled"}
+                return
+            }
+            select {
+            case sem <- struct{}{}:
+            case <-batchCtx.Done():
+                breakers.cancel(target.url)
+                results[idx] = backendResult{ok: false, err: "cancelled"}
+                return
+            }
+            result := fetchBackendInfo(batchCtx, client, target)
+            <-sem
+            if !result.ok && batchCtx.Err() != nil {
+                // The probe was cut short; that says nothing about the backend.
+                breakers.cancel(target.url)
+                results[idx] = backendResult{ok: false, err: "cancelled", latency: result.latency, attempts: result.attempts}
+                return
+            }
+            results[idx] = result
+            breakers.record(target.url, result.ok, time.Now())
+        }(i, target)
+    }
+
+    wg.Wait()
+    botMetrics.recordCheck(results)
+    if snapshotDir != "" && ctx.Err() == nil {
+        if err := writeSnapshot(snapshotDir, snapshotKeep, targets, results, time.Now()); err != nil {
+            slog.Error("write snapshot failed", "error", err)
+        }
+    }
+    return results
+}
+
+func fetchBackendInfo(ctx context.Context, client doer, target backendTarget) (result backendResult) {
+    defer func() { botMetrics.recordProbe(result) }()
+
+    // Only a target known to be private is refused here. A resolver failure
+    // is left to the probe, which retries it like any other transient error;
+    // the dialer still refuses private addresses once the host resolves.
+    checkCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+    err := checkTargetAllowed(checkCtx, target.url)
+    cancel()
+    if errors.Is(err, errBlockedTarget) {
+        slog.Warn("blocked backend", "url", redactURL(target.url), "error", err)
+        return backendResult{ok: false, err: classifyError(err), attempts: 1}
+    }
+
+    if dualStackProbe {
+        if networks := addressFamilies(ctx, target.url); len(networks) > 0 {
+            return probeFamilies(ctx, client, target, networks)
+        }
+    }
+    return probeTarget(ctx, client, target)
+}
+
+// probeTarget probes target, and in PROBE_BOTH mode also its root page,
+// merging what the two responses reveal.
+func probeTarget(ctx context.Context, client doer, target backendTarget) backendResult {
+    if !probeBoth {
+        return probeWithRetries(ctx, client, target)
+    }
+    rootURL := rootTargetURL(target.url)
+    if rootURL == "" || rootURL == target.url {
+        return probeWithRetries(ctx, client, target)
+    }
+
+    root := target
+    root.url = rootURL
+    var rootResult backendResult
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        rootResult = probeWithRetries(ctx, client, root)
+    }()
+    result := probeWithRetries(ctx, client, target)
+    <-done
+    return mergeResults(result, rootResult)
+}
+
+// rootTargetURL returns the page a target's health path hangs off, e.g.
+// "https://host/sub/" for "https://host/sub/version". Targets with a custom
+// path fall back to the host root. It returns "" if the URL cannot be parsed.
+func rootTargetURL(targetURL string) string {
+    parsed, err := url.Parse(targetURL)
+    if err != nil {
+        return ""
+    }
+    path := strings.TrimSuffix(parsed.Path, "/")
+    base, found := strings.CutSuffix(path, "/"+strings.Trim(healthPath, "/"))
+    if !found {
+        base = ""
+    }
+    parsed.Path = base + "/"
+    parsed.RawPath = ""
+    return parsed.String()
+}
+
+// mergeResults combines the health path probe with the root page probe. The
+// health path result is kept unless only the root is online or the root
+// shows the SubConverter-Extended card; empty info fields are filled from
+// the other online result.
+func mergeResults(health, root backendResult) backendResult {
+    primary, other := health, root
+    if (!health.ok && root.ok) || (root.ok && root.typ == "SubConverter-Extended" && health.typ != "SubConverter-Extended") {
+        primary, other = root, health
+    }
+    if !other.ok {
+        return primary
+    }
+
+    if primary.typ == "unknown" {
+        primary.typ = other.typ
+    }
+    fill := func(field *string, value string) {
+        if *field == "" {
+            *field = value
+        }
+    }
+    fill(&primary.info.version, other.info.version)
+    fill(&primary.info.build, other.info.build)
+    fill(&primary.info.buildDate, other.info.buildDate)
+    fill(&primary.info.title, other.info.title)
+    primary.attempts = max(primary.attempts, other.attempts)
+    return primary
+}
+
+func probeWithRetries(ctx context.Context, client doer, target backendTarget) (result backendResult) {
+    for attempt := 0; ; attempt++ {
+        result = fetchBackendOnce(ctx, client, target)
+        result.attempts = attempt + 1
+        result.detail = scrubSecrets(result.detail, target)
+        result.info.snippet = scrubSecrets(result.info.snippet, target)
+        if result.ok || attempt >= backendRetries || !isRetryable(result.err) {
+            return result
+        }
+        if !sleepContext(ctx, retryDelay(attempt)) {
+            return result
+        }
+    }
+}
+
+// probeFamilies probes target once per address family. The first family that
+// is online provides the reported details; all outcomes are listed.
+func probeFamilies(ctx context.Context, client doer, target backendTarget, networks []string) backendResult {
+    var primary backendResult
+    statuses := make([]familyStatus, 0, len(networks))
+    for i, network := range networks {
+        result := probeTarget(context.WithValue(ctx, dialNetworkKey{}, network), client, target)
+        statuses = append(statuses, familyStatus{label: familyLabel(network), ok: result.ok})
+        if i == 0 || (result.ok && !primary.ok) {
+            primary = result
+        }
+    }
+    primary.families = statuses
+    return primary
+}
+
+// addressFamilies returns "tcp4" and/or "tcp6" for the families the target
+// host has addresses in, or nil when it cannot be resolved.
+func addressFamilies(ctx context.Context, targetURL string) []string {
+    parsed, err := url.Parse(targetURL)
+    if err != nil {
+        return nil
+    }
+
+    var ips []net.IP
+    if ip := net.ParseIP(parsed.Hostname()); ip != nil {
+        ips = []net.IP{ip}
+    } else {
+        lookupCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+        defer cancel()
+        resolved, err := backendDNS.lookup(lookupCtx, parsed.Hostname())
+        if err != nil {
+            return nil
+        }
+        ips = resolved
+    }
+
+    has4, has6 := false, false
+    for _, ip := range ips {
+        if ip.To4() != nil {
+            has4 = true
+        } else {
+            has6 = true
+        }
+    }
+    var networks []string
+    if has4 {
+        networks = append(networks, "tcp4")
+    }
+    if has6 {
+        networks = append(networks, "tcp6")
+    }
+    return networks
+}
+
+func familyLabel(network string) string {
+    if network == "tcp6" {
+        return "IPv6"
+    }
+    return "IPv4"
+}
+
+func formatFamilies(statuses []familyStatus) string {
+    parts := make([]string, 0, len(statuses))
+    for _, status := range statuses {
+        mark := "❌"
+        if status.ok {
+            mark = "✅"
+        }
+        parts = append(parts, status.label+": "+mark)
+    }
+    return strings.Join(parts, " / ")
+}
+
+func isRetryable(code string) bool {
+    switch code {
+    case "timeout", "connection_error", "conn_refused", "conn_reset", "dns_error":
+        return true
+    }
+    return false
+}
+
+// retryDelay doubles the base delay per attempt and adds up to 50% jitter.
+func retryDelay(attempt int) time.Duration {
+    delay := retryBaseDelay << attempt
+    return delay + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func fetchBackendOnce(ctx context.Context, client doer, target backendTarget) backendResult {
+    targetURL := target.url
+    ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+    defer cancel()
+
+    var trace *timingTrace
+    if traceTimings {
+        trace = &timingTrace{}
+        ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+    }
+
+    method := probeMethod
+    if target.method != "" {
+        method = target.method
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, targetURL, nil)
+    if err != nil {
+        return backendResult{ok: false, err: "request_error"}
+    }
+    req.Header.Set("User-Agent", probeUserAgent)
+    req.Header.Set("Accept", probeAccept)
+    req.Header.Set("Accept-Encoding", "gzip, deflate")
+    for name, values := range target.headers {
+        req.Header[name] = values
+    }
+
+    start := time.Now()
+    resp, err := client.Do(req)
+    if err != nil {
+        return backendResult{ok: false, err: classifyError(err), detail: err.Error()}
+    }
+    defer resp.Body.Close()
+
+    // The limit applies to the decoded stream. Reading one extra byte tells us
+    // the cap was hit.
+    // HEAD responses carry no body, whatever their Content-Encoding says.
+    var body []byte
+    if method != http.MethodHead {
+        var decoded io.Reader
+        decoded, err = decodeBody(resp)
+        if err == nil {
+            body, err = io.ReadAll(io.LimitReader(decoded, backendBodyLimit+1))
+        }
+    }
+    latency := time.Since(start)
+    if err != nil {
+        return backendResult{ok: false, err: "read_error", latency: latency, detail: err.Error()}
+    }
+    headers := resp.Header.Clone()
+    finalURL := ""
+    if resp.Request != nil && resp.Request.URL.String() != targetURL {
+        finalURL = resp.Request.URL.String()
+    }
+    scheme := schemeChange(targetURL, finalURL)
+    oversized := len(body) > backendBodyLimit
+    if oversized {
+        body = body[:backendBodyLimit]
+        slog.Warn("backend response exceeds body limit", "url", redactURL(targetURL), "limit", backendBodyLimit)
+    }
+
+    if isMaintenance(resp.StatusCode, body) {
+        return backendResult{ok: false, status: resp.StatusCode, err: "maintenance", latency: latency, oversized: oversized, headers: headers, finalURL: finalURL, bodySize: len(body), scheme: scheme}
+    }
+    if !successStatus.matches(resp.StatusCode) {
+        return backendResult{ok: false, status: resp.StatusCode, err: fmt.Sprintf("HTTP %d", resp.StatusCode), latency: latency, oversized: oversized, headers: headers, finalURL: finalURL, bodySize: len(body), scheme: scheme}
+    }
+
+    expect := expectContains
+    if target.expect != "" {
+        expect = target.expect
+    }
+    if expect != "" && method != http.MethodHead && !strings.Contains(string(body), expect) {
+        return backendResult{ok: false, status: resp.StatusCode, err: "content_mismatch", latency: latency, oversized: oversized, headers: headers, finalURL: finalURL, bodySize: len(body), scheme: scheme}
+    }
+
+    // A HEAD probe only tells us the backend is up, so detection is skipped.
+    typ, info := "unknown", backendInfo{}
+    if method != http.MethodHead {
+        typ, info = detectBackend(strings.TrimSpace(string(body)))
+    }
+    result := backendResult{ok: true, status: resp.StatusCode, typ: typ, info: info, latency: latency, oversized: oversized, headers: headers, finalURL: finalURL, bodySize: len(body), scheme: scheme}
+    result.skew, result.hasSkew = computeClockSkew(resp.Header.Get("Date"), start, start.Add(latency))
+    if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+        result.certExpiry = resp.TLS.PeerCertificates[0].NotAfter
+    }
+    if trace != nil {
+        result.timings = trace.snapshot()
+    }
+
+    return result
+}
+
+func (t *timingTrace) clientTrace() *httptrace.ClientTrace {
+    return &httptrace.ClientTrace{
+        GetConn:              func(string) { t.mark(&t.start) },
+        DNSStart:             func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+        DNSDone:              func(httptrace.DNSDoneInfo) { t.elapsed(&t.timings.dns, &t.dnsStart) },
+        ConnectStart:         func(string, string) { t.mark(&t.connectStart) },
+        ConnectDone:          func(string, string, error) { t.elapsed(&t.timings.connect, &t.connectStart) },
+        TLSHandshakeStart:    func() { t.mark(&t.tlsStart) },
+        TLSHandshakeDone:     func(tls.ConnectionState, error) { t.elapsed(&t.timings.tls, &t.tlsStart) },
+        GotFirstResponseByte: func() { t.elapsed(&t.timings.ttfb, &t.start) },
+    }
+}
+
+func (t *timingTrace) mark(at *time.Time) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if at.IsZero() {
+        *at = time.Now()
+    }
+}
+
+func (t *timingTrace) elapsed(into *time.Duration, since *time.Time) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if !since.IsZero() && *into == 0 {
+        *into = time.Since(*since)
+    }
+}
+
+func (t *timingTrace) snapshot() phaseTimings {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.timings
+}
+
+// formatTimings renders the phases that ran, e.g. "DNS 12ms · 连接 34ms".
+func formatTimings(timings phaseTimings) string {
+    phases := []struct {
+        label    string
+        duration time.Duration
+    }{
+        {"DNS", timings.dns},
+        {tr("phase_connect"), timings.connect},
+        {"TLS", timings.tls},
+        {"TTFB", timings.ttfb},
+    }
+
+    parts := make([]string, 0, len(phases))
+    for _, phase := range phases {
+        if phase.duration > 0 {
+            parts = append(parts, fmt.Sprintf("%s %dms", phase.label, phase.duration.Milliseconds()))
+        }
+    }
+    return strings.Join(parts, " · ")
+}
+
+// redactURL masks query values and passwords so token-bearing target URLs can
+// be logged.
+func redactURL(raw string) string {
+    parsed, err := url.Parse(raw)
+    if err != nil {
+        return raw
+    }
+    if _, hasPassword := parsed.User.Password(); hasPassword {
+        parsed.User = url.UserPassword(parsed.User.Username(), "***")
+    }
+    if parsed.RawQuery != "" {
+        var keys []string
+        for key := range parsed.Query() {
+            keys = append(keys, url.QueryEscape(key)+"=***")
+        }
+        sort.Strings(keys)
+        parsed.RawQuery = strings.Join(keys, "&")
+    }
+    return parsed.String()
+}
+
+// scrubSecrets removes the target's header values and query string from text
+// that may be shown to users, such as error details and body snippets.
+func scrubSecrets(text string, target backendTarget) string {
+    if text == "" {
+        return text
+    }
+    text = strings.ReplaceAll(text, target.url, redactURL(target.url))
+    var secrets []string
+    for _, values := range target.headers {
+        secrets = append(secrets, values...)
+    }
+    if parsed, err := url.Parse(target.url); err == nil {
+        for _, values := range parsed.Query() {
+            secrets = append(secrets, values...)
+        }
+    }
+    // Very short values would mangle unrelated text and are not secrets.
+    for _, secret := range secrets {
+        if len(secret) >= 4 {
+            text = strings.ReplaceAll(text, secret, "***")
+        }
+    }
+    return text
+}
+
+// decodeBody wraps the response body according to its Content-Encoding. Since
+// the probe sets Accept-Encoding itself, the transport leaves decoding to us.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+    switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+    case "", "identity":
+        return resp.Body, nil
+    case "gzip", "x-gzip":
+        return gzip.NewReader(resp.Body)
+    case "deflate":
+        // "deflate" is meant to be zlib-wrapped, but some servers send a raw
+        // stream, so fall back to plain flate when the zlib header is missing.
+        buffered := bufio.NewReader(resp.Body)
+        header, err := buffered.Peek(2)
+        if err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+            return zlib.NewReader(buffered)
+        }
+        return flate.NewReader(buffered), nil
+    default:
+        return nil, fmt.Errorf("unsupported content encoding %q", resp.Header.Get("Content-Encoding"))
+    }
+}
+
+// computeClockSkew compares the backend's Date header against the midpoint of
+// the request window. A positive skew means the backend clock is ahead.
+func computeClockSkew(header string, start, end time.Time) (time.Duration, bool) {
+    if header == "" {
+        return 0, false
+    }
+    serverTime, err := http.ParseTime(header)
+    if err != nil {
+        return 0, false
+    }
+
+    local := start.Add(end.Sub(start) / 2)
+    return serverTime.Sub(local).Round(time.Second), true
+}
+
+// latencyIndicator picks a traffic light for an online backend's latency.
+func latencyIndicator(latency time.Duration) string {
+    switch {
+    case latency >= latencyBad:
+        return "🔴"
+    case latency >= latencyWarn:
+        return "🟡"
+    default:
+        return "🟢"
+    }
+}
+
+func formatClockSkew(skew time.Duration) string {
+    line := trf("clock_skew", int(skew.Seconds()))
+    if skew > clockSkewWarn || skew < -clockSkewWarn {
+        line += " ⚠️"
+    }
+    return line
+}
+
+// formatBodySize shows how much of the response body was read. A body cut at
+// backendBodyLimit is marked so the size is not mistaken for the real one.
+func formatBodySize(result backendResult) string {
+    line := trf("body_size", formatBytes(result.bodySize))
+    if result.oversized {
+        line += tr("body_truncated")
+    }
+    return line
+}
+
+func formatBytes(n int) string {
+    switch {
+    case n >= 1024*1024:
+        return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+    case n >= 1024:
+        return fmt.Sprintf("%.1f KB", float64(n)/1024)
+    default:
+        return fmt.Sprintf("%d B", n)
+    }
+}
+
+// formatUptime renders a duration compactly, e.g. "3h12m" or "2d5h".
+func formatUptime(d time.Duration) string {
+    switch {
+    case d >= 24*time.Hour:
+        return fmt.Sprintf("%dd%dh", int(d/(24*time.Hour)), int(d%(24*time.Hour)/time.Hour))
+    case d >= time.Hour:
+        return fmt.Sprintf("%dh%dm", int(d/time.Hour), int(d%time.Hour/time.Minute))
+    case d >= time.Minute:
+        return fmt.Sprintf("%dm", int(d/time.Minute))
+    default:
+        return fmt.Sprintf("%ds", int(d/time.Second))
+    }
+}
+
+// buildDateLayouts are the build date formats backends are known to report,
+// including the C __DATE__ style "Jan  5 2024" once spaces are collapsed.
+var buildDateLayouts = []string{
+    time.RFC3339,
+    "2006-01-02 15:04:05",
+    "2006-01-02",
+    "2006/01/02 15:04:05",
+    "2006/01/02",
+    "Jan 2 2006 15:04:05",
+    "Jan 2 2006",
+}
+
+// formatBuildDate renders a build date with its age in days. Dates that
+// cannot be parsed are shown as reported.
+func formatBuildDate(raw string, now time.Time) string {
+    normalized := strings.Join(strings.Fields(raw), " ")
+    for _, layout := range buildDateLayouts {
+        built, err := time.Parse(layout, normalized)
+        if err != nil {
+            continue
+        }
+        days := max(int(now.Sub(built).Hours()/24), 0)
+        return mdText(tr("build_date")) + mdCode(built.Format("2006-01-02")) + mdText(trf("build_age", days))
+    }
+    return mdText(tr("build_date")) + mdCode(raw)
+}
+
+func formatCertExpiry(expiry time.Time, now time.Time) string {
+    days := int(math.Floor(expiry.Sub(now).Hours() / 24))
+    if days < 0 {
+        return trf("cert_expired", -days)
+    }
+
+    line := trf("cert_expires", days)
+    if days < certWarnDays {
+        line = "⚠️ " + line
+    }
+    return line
+}
+
+// checkTargetAllowed refuses targets that resolve to private, loopback or
+// link-local addresses unless ALLOW_PRIVATE_TARGETS is set.
+func checkTargetAllowed(ctx context.Context, targetURL string) error {
+    if allowPrivateTargets {
+        return nil
+    }
+
+    parsed, err := url.Parse(targetURL)
+    if err != nil {
+        return err
+    }
+    host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+    if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".onion") {
+        return fmt.Errorf("%w: host %s", errBlockedTarget, host)
+    }
+
+    if ip := net.ParseIP(host); ip != nil {
+        if isPrivateIP(ip) {
+            return fmt.Errorf("%w: address %s is private", errBlockedTarget, ip)
+        }
+        return nil
+    }
+
+    // Going through the probe's DNS cache checks the addresses that will
+    // actually be dialed. A host that cannot be resolved is not probed.
+    ips, err := backendDNS.lookup(ctx, host)
+    if err != nil {
+        return err
+    }
+    for _, ip := range ips {
+        if isPrivateIP(ip) {
+            return fmt.Errorf("%w: host %s resolves to private address %s", errBlockedTarget, host, ip)
+        }
+    }
+    return nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+    return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+func classifyError(err error) string {
+    if errors.Is(err, errBlockedTarget) {
+        return "blocked_private"
+    }
+
+    if isTLSError(err) {
+        return "tls_error"
+    }
+
+    if errors.Is(err, context.DeadlineExceeded) {
+        return "timeout"
+    }
+
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        return "timeout"
+    }
+
+    var dnsErr *net.DNSError
+    switch {
+    case errors.As(err, &dnsErr):
+        return "dns_error"
+    case errors.Is(err, syscall.ECONNREFUSED):
+        return "conn_refused"
+    case errors.Is(err, syscall.ECONNRESET):
+        return "conn_reset"
+    }
+
+    return "connection_error"
+}
+
+func isTLSError(err error) bool {
+    var recordErr tls.RecordHeaderError
+    var alertErr tls.AlertError
+    var verifyErr *tls.CertificateVerificationError
+    var authorityErr x509.UnknownAuthorityError
+    var invalidErr x509.CertificateInvalidError
+    var hostnameErr x509.HostnameError
+    if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+        errors.As(err, &authorityErr) || errors.As(err, &invalidErr) || errors.As(err, &hostnameErr) {
+        return true
+    }
+
+    // net/http reports handshake timeouts with an unexported error type, and
+    // replaces the record header error of a plain HTTP reply with its own.
+    text := err.Error()
+    return strings.Contains(text, "TLS handshake timeout") || strings.Contains(text, "server gave HTTP response to HTTPS client")
+}
+
+func detectBackend(text string) (string, backendInfo) {
+    if info, ok := parseExtendedInfo(text); ok {
+        return "SubConverter-Extended", info
+    }
+
+    trimmed := strings.TrimSpace(text)
+    if versionPattern.MatchString(trimmed) || strings.Contains(strings.ToLower(trimmed), "subconverter") {
+        return "subconverter", backendInfo{version: parseSubconverterVersion(trimmed)}
+    }
+
+    if typ, info, ok := detectOtherBackend(trimmed); ok {
+        return typ, info
+    }
+
+    return "unknown", backendInfo{snippet: compactSnippet(trimmed, 200)}
+}
+
+// parseSubconverterVersion extracts "v1.2.3-abc" from the canonical
+// "subconverter v1.2.3-abc backend" banner and returns other banners as-is.
+func parseSubconverterVersion(banner string) string {
+    if match := versionPattern.FindStringSubmatch(banner); match != nil {
+        return match[1]
+    }
+    return banner
+}
+
+// detectOtherBackend recognizes non-subconverter services that commonly sit
+// next to one: the sub-web frontend, a raw Clash config and JSON APIs.
+func detectOtherBackend(text string) (string, backendInfo, bool) {
+    if match := htmlTitlePattern.FindStringSubmatch(text); match != nil {
+        title := stripHTML(match[1])
+        if subWebPattern.MatchString(title) || subWebPattern.MatchString(text) {
+            return "sub-web", backendInfo{title: compactSnippet(title, 100)}, true
+        }
+    }
+
+    if clashProxiesPattern.MatchString(text) {
+        return "clash-config", backendInfo{}, true
+    }
+
+    if (strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[")) && json.Valid([]byte(text)) {
+        return "json", backendInfo{snippet: compactSnippet(text, 200)}, true
+    }
+
+    return "", backendInfo{}, false
+}
+
+func parseExtendedInfo(text string) (backendInfo, bool) {
+    if !extendedMarker.MatchString(text) {
+        return backendInfo{}, false
+    }
+
+    matches := infoCardPattern.FindAllStringSubmatch(text, -1)
+    if len(matches) == 0 {
+        return backendInfo{}, false
+    }
+
+    info := backendInfo{}
+    for _, match := range matches {
+        label := strings.ToLower(strings.TrimSpace(match[1]))
+        value := stripHTML(match[2])
+
+        switch label {
+        case "version":
+            info.version = value
+        case "build":
+            info.build = value
+        case "build date":
+            info.buildDate = value
+        }
+    }
+
+    if info.version == "" && info.build == "" && info.buildDate == "" {
+        return backendInfo{}, false
+    }
+
+    return info, true
+}
+
+func stripHTML(value string) string {
+    return strings.TrimSpace(tagPattern.ReplaceAllString(value, ""))
+}
+
+// compactSnippet flattens text to a single line of at most limit runes.
+// Invalid UTF-8 and control characters are dropped so the snippet is always
+// safe to send; escaping for the parse mode is left to mdText and mdCode.
+func compactSnippet(text string, limit int) string {
+    text = strings.ToValidUTF8(text, "")
+    text = whitespacePattern.ReplaceAllString(text, " ")
+    text = strings.Map(func(r rune) rune {
+        if unicode.IsControl(r) {
+            return -1
+        }
+        return r
+    }, text)
+    text = redactSnippet(text)
+    if runes := []rune(text); len(runes) > limit {
+        // Back off to the start of an emoji sequence or a letter with
+        // combining marks rather than cut it in half.
+        cut := limit
+        for cut > 0 && splitsCluster(runes, cut) {
+            cut--
+        }
+        if cut == 0 {
+            cut = limit
+        }
+        return string(runes[:cut]) + "..."
+    }
+    return text
+}
+
+// splitsCluster reports whether cutting runes before index i would separate
+// characters that render as one: ZWJ sequences, variation selectors, skin
+// tones, tag sequences, combining marks and regional-indicator flag pairs.
+func splitsCluster(runes []rune, i int) bool {
+    r, prev := runes[i], runes[i-1]
+    switch {
+    case r == '\u200d' || prev == '\u200d':
+        return true
+    case r == '\ufe0e' || r == '\ufe0f':
+        return true
+    case r >= 0x1f3fb && r <= 0x1f3ff:
+        return true
+    case r >= 0xe0020 && r <= 0xe007f:
+        return true
+    case unicode.In(r, unicode.Mn, unicode.Me):
+        return true
+    case isRegionalIndicator(r) && isRegionalIndicator(prev):
+        // Flags pair up from the start of a run of indicators.
+        run := 0
+        for j := i - 1; j >= 0 && isRegionalIndicator(runes[j]); j-- {
+            run++
+        }
+        return run%2 == 1
+    }
+    return false
+}
+
+func isRegionalIndicator(r rune) bool {
+    return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+func redactSnippet(text string) string {
+    for _, pattern := range redactPatterns {
+        text = pattern.ReplaceAllString(text, "***")
+    }
+    return text
+}
+
+func formatBackendBlock(index int, display string, result backendResult) string {
+	lines := []string{mdBold(fmt.Sprintf("[%d] %s", index, display))}
+
+	if !result.ok {
+		lines = append(lines, mdText(trf("type", tr("type_unknown"))))
+		if result.err == "maintenance" {
+			lines = append(lines, mdText("🛠 "+tr("status_maintenance")))
+		} else {
+			lines = append(lines, mdText("❌ "+tr("status_offline")))
+		}
+		if len(result.families) > 0 {
+			lines = append(lines, mdText(formatFamilies(result.families)))
+		}
+		if result.err != "" && result.err != "maintenance" {
+			lines = append(lines, mdText(trf("error", errorLabel(result.err))))
+		}
+		if result.finalURL != "" {
+			lines = append(lines, mdText(trf("redirected", redirectHost(result.finalURL))))
+		}
+		if result.scheme != "" {
+			lines = append(lines, mdText(tr("scheme_"+result.scheme)))
+		}
+		if server := serverLabel(result.headers); server != "" {
+			lines = append(lines, mdText(trf("server", server)))
+		}
+		if result.bodySize > 0 {
+			lines = append(lines, mdText(formatBodySize(result)))
+		}
+		if diagMode && result.detail != "" {
+			lines = append(lines, mdText(trf("detail", result.detail)))
+		}
+		if result.attempts > 1 {
+			lines = append(lines, mdText(trf("retried", result.attempts-1)))
+		}
+		if result.oversized {
+			lines = append(lines, mdText(tr("oversized")))
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	lines = append(lines, mdText(trf("type", typeLabel(result.typ))))
+	lines = append(lines, mdText(latencyIndicator(result.latency)+" "+tr("status_online")))
+	if len(result.families) > 0 {
+		lines = append(lines, mdText(formatFamilies(result.families)))
+	}
+	lines = append(lines, mdText(trf("latency", result.latency.Milliseconds())))
+	if timings := formatTimings(result.timings); timings != "" {
+		lines = append(lines, mdText(timings))
+	}
+	if result.finalURL != "" {
+		lines = append(lines, mdText(trf("redirected", redirectHost(result.finalURL))))
+	}
+	if result.scheme != "" {
+		lines = append(lines, mdText(tr("scheme_"+result.scheme)))
+	}
+	if result.attempts > 1 {
+		lines = append(lines, mdText(trf("retried", result.attempts-1)))
+	}
+	if result.oversized {
+		lines = append(lines, mdText(tr("oversized")))
+	}
+	if !result.certExpiry.IsZero() {
+		lines = append(lines, mdText(formatCertExpiry(result.certExpiry, time.Now())))
+	}
+	if diagMode && result.hasSkew {
+		lines = append(lines, mdText(formatClockSkew(result.skew)))
+	}
+	switch result.typ {
+	case "unknown", "subconverter", "SubConverter-Extended":
+		if server := serverLabel(result.headers); server != "" {
+			lines = append(lines, mdText(trf("server", server)))
+		}
+		if result.bodySize > 0 {
+			lines = append(lines, mdText(formatBodySize(result)))
+		}
+	}
+
+	if result.typ == "SubConverter-Extended" {
+		if result.info.version != "" {
+			lines = append(lines, mdText(tr("version"))+mdCode(result.info.version))
+		}
+		if result.info.build != "" {
+			lines = append(lines, mdText(tr("build"))+mdCode(result.info.build))
+		}
+		if result.info.buildDate != "" {
+			lines = append(lines, formatBuildDate(result.info.buildDate, time.Now()))
+		}
+	} else if result.typ == "subconverter" {
+		if result.info.version != "" {
+			lines = append(lines, mdText(tr("version"))+mdCode(result.info.version))
+		}
+	} else if result.typ == "sub-web" {
+		if result.info.title != "" {
+			lines = append(lines, mdText(trf("page_title", result.info.title)))
+		}
+	} else if result.typ == "clash-config" {
+		lines = append(lines, mdText(tr("clash_config")))
+	} else if result.typ == "json" {
+		lines = append(lines, mdText(tr("json_body"))+mdCode(result.info.snippet))
+	} else if result.info.snippet != "" {
+		lines = append(lines, mdText(trf("content", result.info.snippet)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// messages holds the user-facing strings of the status report per language.
+var messages = map[string]map[string]string{
+    "zh": {
+        "no_backends":          "未配置后端地址，请设置 BACKEND_URLS 环境变量。",
+        "report_continued":     "报告剩余部分 (接上文消息)",
+        "title":                "后端状态 (%d) 在线 %d / 离线 %d",
+        "title_maintenance":    "后端状态 (%d) ✅ %d / 🛠 %d / ❌ %d",
+        "single_title":         "后端状态",
+        "all_online":           "全部在线 ✅",
+        "group_header":         "%s %s (在线 %d / 离线 %d)",
+        "group_default":        "未分组",
+        "latency_summary":      "⏱ 平均 %dms · 最慢 %dms (%s)",
+        "none_online":          "没有在线的后端 ❌",
+        "truncated":            " - 仅显示前 %d 个",
+        "cached":               " (缓存 %ds 前)",
+        "availability":         "加权可用率: %.1f%%",
+        "uptime":               "机器人运行 %s · 数据采集于 %s",
+        "below_threshold":      " ⚠️ 低于阈值 %.0f%%",
+        "version_match":        "✅ 版本一致: %s",
+        "version_mismatch":     "⚠️ 版本不一致",
+        "version_count":        "  %s: %d 个后端",
+        "type":                 "类型: %s",
+        "type_unknown":         "未知",
+        "status_online":        "状态: 在线",
+        "status_offline":       "状态: 离线",
+        "status_maintenance":   "状态: 维护中",
+        "error":                "错误: %s",
+        "retried":              "重试 %d 次",
+        "oversized":            "⚠️ 响应过大",
+        "latency":              "⏱ 延迟: %dms",
+        "redirected":           "↪ 重定向至 %s",
+        "scheme_downgrade":     "⚠️ 降级到 HTTP",
+        "scheme_upgrade":       "🔒 已升级到 HTTPS",
+        "server":               "🖥 服务器: %s",
+        "body_size":            "📦 大小: %s",
+        "body_truncated":       " (已截断)",
+        "phase_connect":        "连接",
+        "cert_expires":         "🔐 证书: %d 天后到期",
+        "cert_expired":         "⚠️ 🔐 证书: 已过期 %d 天",
+        "clock_skew":           "🕐 时钟偏差: %+ds",
+        "version":              "版本: ",
+        "build":                "构建: ",
+        "build_date":           "📅 构建: ",
+        "build_age":            " (%d 天前)",
+        "content":              "内容: %s",
+        "page_title":           "🌐 页面标题: %s",
+        "clash_config":         "📄 Clash 配置文件",
+        "json_body":            "🧾 JSON: ",
+        "err_timeout":          "超时",
+        "err_connection_error": "连接失败",
+        "err_dns_error":        "DNS 解析失败",
+        "err_conn_refused":     "连接被拒绝",
+        "err_conn_reset":       "连接重置",
+        "err_request_error":    "请求构造失败",
+        "err_read_error":       "读取响应失败",
+        "err_blocked_private":  "已拦截内网地址",
+        "err_tls_error":        "🔒 TLS 握手失败",
+        "err_breaker_open":     "熔断中 (跳过探测)",
+        "err_content_mismatch": "内容校验失败",
+        "err_maintenance":      "维护中",
+        "err_cancelled":        "检测已取消或超时",
+        "err_unknown":          "未知错误 (%s)",
+        "detail":               "详情: %s",
+    },
+    "en": {
+        "no_backends":          "No backends configured. Please set the BACKEND_URLS environment variable.",
+        "report_continued":     "Rest of the report, continued from the messages above",
+        "title":                "Backend status (%d) online %d / offline %d",
+        "title_maintenance":    "Backend status (%d) ✅ %d / 🛠 %d / ❌ %d",
+        "single_title":         "Backend status",
+        "all_online":           "All online ✅",
+        "group_header":         "%s %s (online %d / offline %d)",
+        "group_default":        "Untagged",
+        "latency_summary":      "⏱ Average %dms · slowest %dms (%s)",
+        "none_online":          "No backend is online ❌",
+        "truncated":            " - showing first %d only",
+        "cached":               " (cached %ds ago)",
+        "availability":         "Weighted availability: %.1f%%",
+        "uptime":               "Bot up %s · data from %s",
+        "below_threshold":      " ⚠️ below threshold %.0f%%",
+        "version_match":        "✅ Versions match: %s",
+        "version_mismatch":     "⚠️ Version mismatch",
+        "version_count":        "  %s: %d backend(s)",
+        "type":                 "Type: %s",
+        "type_unknown":         "unknown",
+        "status_online":        "Status: online",
+        "status_offline":       "Status: offline",
+        "status_maintenance":   "Status: under maintenance",
+        "error":                "Error: %s",
+        "retried":              "retried %d time(s)",
+        "oversized":            "⚠️ response too large",
+        "latency":              "⏱ Latency: %dms",
+        "redirected":           "↪ Redirected to %s",
+        "scheme_downgrade":     "⚠️ Downgraded to HTTP",
+        "scheme_upgrade":       "🔒 Upgraded to HTTPS",
+        "server":               "🖥 Server: %s",
+        "body_size":            "📦 Size: %s",
+        "body_truncated":       " (truncated)",
+        "phase_connect":        "connect",
+        "cert_expires":         "🔐 Certificate: expires in %d days",
+        "cert_expired":         "⚠️ 🔐 Certificate: expired %d days ago",
+        "clock_skew":           "🕐 Clock skew: %+ds",
+        "version":              "Version: ",
+        "build":                "Build: ",
+        "build_date":           "📅 Built: ",
+        "build_age":            " (%d days ago)",
+        "content":              "Content: %s",
+        "page_title":           "🌐 Page title: %s",
+        "clash_config":         "📄 Clash config file",
+        "json_body":            "🧾 JSON: ",
+        "err_timeout":          "timeout",
+        "err_connection_error": "connection failed",
+        "err_dns_error":        "DNS lookup failed",
+        "err_conn_refused":     "connection refused",
+        "err_conn_reset":       "connection reset",
+        "err_request_error":    "invalid request",
+        "err_read_error":       "failed to read response",
+        "err_blocked_private":  "private address blocked",
+        "err_tls_error":        "🔒 TLS handshake failed",
+        "err_breaker_open":     "circuit open (probe skipped)",
+        "err_content_mismatch": "content check failed",
+        "err_maintenance":      "under maintenance",
+        "err_cancelled":        "check cancelled or timed out",
+        "err_unknown":          "unknown error (%s)",
+        "detail":               "Detail: %s",
+    },
+}
+
+// schemeChange reports "downgrade" when redirects took an HTTPS target to
+// plain HTTP, "upgrade" for the reverse, and "" otherwise.
+func schemeChange(targetURL, finalURL string) string {
+    if finalURL == "" {
+        return ""
+    }
+    from, err := url.Parse(targetURL)
+    if err != nil {
+        return ""
+    }
+    to, err := url.Parse(finalURL)
+    if err != nil {
+        return ""
+    }
+
+    switch {
+    case from.Scheme == "https" && to.Scheme == "http":
+        return "downgrade"
+    case from.Scheme == "http" && to.Scheme == "https":
+        return "upgrade"
+    default:
+        return ""
+    }
+}
+
+func redirectHost(rawURL string) string {
+    parsed, err := url.Parse(rawURL)
+    if err != nil || parsed.Host == "" {
+        return rawURL
+    }
+    return parsed.Host
+}
+
+// cdnHeaders maps a response header to the CDN that sets it.
+var cdnHeaders = []struct {
+    header string
+    name   string
+}{
+    {"Cf-Ray", "cloudflare"},
+    {"X-Amz-Cf-Id", "cloudfront"},
+    {"X-Fastly-Request-Id", "fastly"},
+    {"X-Akamai-Transformed", "akamai"},
+    {"X-Vercel-Id", "vercel"},
+    {"X-Nf-Request-Id", "netlify"},
+}
+
+// serverLabel describes what answered a probe: the Server header plus the
+// CDN in front of it when one can be told from the response headers.
+func serverLabel(headers http.Header) string {
+    server := strings.TrimSpace(headers.Get("Server"))
+    cdn := ""
+    for _, entry := range cdnHeaders {
+        if headers.Get(entry.header) != "" {
+            cdn = entry.name
+            break
+        }
+    }
+
+    switch {
+    case cdn == "" || strings.Contains(strings.ToLower(server), cdn):
+        return server
+    case server == "":
+        return cdn
+    default:
+        return server + " (" + cdn + ")"
+    }
+}
+
+func tr(key string) string {
+    if text, ok := messages[botLang][key]; ok {
+        return text
+    }
+    return messages[defaultLang][key]
+}
+
+func trf(key string, args ...any) string {
+    return fmt.Sprintf(tr(key), args...)
+}
+
+// isMaintenance reports whether a response announces planned downtime: a 503
+// not accepted by SUCCESS_STATUS, or a body matching MAINTENANCE_PATTERN.
+func isMaintenance(status int, body []byte) bool {
+    if maintenancePattern != nil && maintenancePattern.Match(body) {
+        return true
+    }
+    return status == http.StatusServiceUnavailable && !successStatus.matches(status)
+}
+
+func loadMaintenancePattern() *regexp.Regexp {
+    raw := os.Getenv("MAINTENANCE_PATTERN")
+    if strings.TrimSpace(raw) == "" {
+        return nil
+    }
+    pattern, err := regexp.Compile(raw)
+    if err != nil {
+        slog.Warn("invalid MAINTENANCE_PATTERN, ignoring", "pattern", raw, "error", err)
+        return nil
+    }
+    return pattern
+}
+
+// errorLabel localizes an error classification. HTTP status errors are
+// shown verbatim; unrecognized codes get a generic label.
+func errorLabel(code string) string {
+    if strings.HasPrefix(code, "HTTP ") {
+        return code
+    }
+    if text, ok := messages[botLang]["err_"+code]; ok {
+        return text
+    }
+    if text, ok := messages[defaultLang]["err_"+code]; ok {
+        return text
+    }
+    return trf("err_unknown", code)
+}
+
+func typeLabel(typ string) string {
+    if typ == "unknown" {
+        return tr("type_unknown")
+    }
+    return typ
+}
+
+// mdText escapes plain text for the configured parse mode.
+func mdText(text string) string {
+    if parseMode == markdownV2 {
+        return escapeMarkdownV2(text)
+    }
+    return text
+}
+
+func mdBold(text string) string {
+    if parseMode == markdownV2 {
+        return "*" + escapeMarkdownV2(text) + "*"
+    }
+    return text
+}
+
+func mdCode(text string) string {
+    if parseMode == markdownV2 {
+        return "`" + markdownCodeEscaper.Replace(text) + "`"
+    }
+    return text
+}
+
+func escapeMarkdownV2(text string) string {
+    return markdownEscaper.Replace(text)
+}
+
+// loadBackendTargets returns the active backend list. It is parsed from the
+// environment on first use and replaced by reloadTargets on SIGHUP.
+func loadBackendTargets() ([]backendTarget, bool) {
+    set := activeTargets.Load()
+    if set == nil {
+        targets, truncated, err := parseBackendTargets(os.Getenv)
+        set = &targetSet{targets: targets, truncated: truncated}
+        if activeTargets.CompareAndSwap(nil, set) && err != nil {
+            slog.Warn("skipping backends", "error", err)
+        }
+    }
+    return set.targets, set.truncated
+}
+
+// reloadTargets re-reads the backend variables, overlaying CONFIG_FILE when
+// set since the process environment itself cannot change, and swaps in the
+// new list only if it parses cleanly.
+func reloadTargets() {
+    getenv := os.Getenv
+    if path := strings.TrimSpace(os.Getenv("CONFIG_FILE")); path != "" {
+        values, err := readEnvFile(path)
+        if err != nil {
+            slog.Error("reload failed, keeping current backends", "path", path, "error", err)
+            return
+        }
+        getenv = func(name string) string {
+            if value, ok := values[name]; ok {
+                return value
+            }
+            return os.Getenv(name)
+        }
+    }
+
+    targets, truncated, err := parseBackendTargets(getenv)
+    if err != nil {
+        slog.Error("reload failed, keeping current backends", "error", err)
+        return
+    }
+    old, _ := loadBackendTargets()
+    activeTargets.Store(&targetSet{targets: targets, truncated: truncated})
+    slog.Info("backends reloaded", "old_count", len(old), "new_count", len(targets))
+}
+
+// readEnvFile parses KEY=VALUE lines, ignoring blank lines and # comments.
+// Values may be wrapped in single or double quotes.
+func readEnvFile(path string) (map[string]string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    values := map[string]string{}
+    for i, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+        key = strings.TrimSpace(key)
+        if !ok || key == "" {
+            return nil, fmt.Errorf("line %d: expected KEY=VALUE", i+1)
+        }
+        value = strings.TrimSpace(value)
+        if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+            value = value[1 : len(value)-1]
+        }
+        values[key] = value
+    }
+    return values, nil
+}
+
+// parseBackendTargets builds the backend list from BACKEND_URLS (or
+// BACKEND_URL) and BACKEND_HEADERS_<n> as returned by getenv. Invalid entries
+// are skipped but reported in the error.
+func parseBackendTargets(getenv func(string) string) ([]backendTarget, bool, error) {
+    raw := strings.TrimSpace(getenv("BACKEND_URLS"))
+    if raw == "" {
+        raw = strings.TrimSpace(getenv("BACKEND_URL"))
+    }
+    if raw == "" {
+        raw = defaultBackend
+    }
+
+    items := parseBackendList(raw)
+    var invalid []string
+
+    // Duplicates are dropped before the cap so it counts distinct backends.
+    targets := make([]backendTarget, 0, len(items))
+    seen := make(map[string]bool, len(items))
+    for i, item := range items {
+        base, options := splitTargetOptions(item)
+        base, tag := splitTargetTag(base)
+        if _, ok := options["group"]; !ok && tag != "" {
+            options["group"] = tag
+        }
+        display, urlValue := normalizeBackendTarget(base, parseTargetNormalize(options))
+        if display == "" || urlValue == "" {
+            invalid = append(invalid, redactEntry(item))
+            continue
+        }
+        if seen[urlValue] {
+            continue
+        }
+        seen[urlValue] = true
+        targets = append(targets, backendTarget{
+            display:   display,
+            url:       urlValue,
+            weight:    parseTargetWeight(options),
+            group:     options["group"],
+            alertChat: parseTargetChat(options),
+            headers:   loadTargetHeaders(getenv, i+1),
+            method:    parseProbeMethod(options["method"], "backend method"),
+            expect:    options["expect"],
+        })
+    }
+
+    truncated := len(targets) > maxBackends
+    if truncated {
+        targets = targets[:maxBackends]
+    }
+    if len(invalid) > 0 {
+        return targets, truncated, fmt.Errorf("invalid backend entries: %s", strings.Join(invalid, ", "))
+    }
+    return targets, truncated, nil
+}
+
+func parseBackendList(value string) []string {
+    if value == "" {
+        return nil
+    }
+
+    return strings.FieldsFunc(value, func(r rune) bool {
+        switch r {
+        case ',', ' ', '\t', '\n', '\r':
+            return true
+        default:
+            return false
+        }
+    })
+}
+
+// splitTargetTag removes a leading "tag:<name>|" from a target entry, as in
+// "tag:us|Name|https://host". The tag is the same as an @group option.
+func splitTargetTag(raw string) (string, string) {
+    rest, ok := strings.CutPrefix(raw, "tag:")
+    if !ok {
+        return raw, ""
+    }
+    tag, rest, ok := strings.Cut(rest, "|")
+    if !ok || tag == "" {
+        return raw, ""
+    }
+    return rest, tag
+}
+
+// splitTargetOptions peels trailing "@key=value" options off a target entry,
+// e.g. "api.example.com@weight=3".
+func splitTargetOptions(raw string) (string, map[string]string) {
+    options := map[string]string{}
+    for {
+        match := targetOptionPattern.FindStringSubmatchIndex(raw)
+        if match == nil {
+            return raw, options
+        }
+        key := raw[match[2]:match[3]]
+        if _, exists := options[key]; !exists {
+            options[key] = raw[match[4]:match[5]]
+        }
+        raw = raw[:match[0]]
+    }
+}
+
+// loadTargetHeaders reads extra request headers for the n-th entry of
+// BACKEND_URLS from BACKEND_HEADERS_<n>, one "Name: value" per line or
+// separated by ";".
+func loadTargetHeaders(getenv func(string) string, n int) http.Header {
+    raw := getenv(fmt.Sprintf("BACKEND_HEADERS_%d", n))
+    if strings.TrimSpace(raw) == "" {
+        return nil
+    }
+
+    headers := http.Header{}
+    for _, entry := range strings.FieldsFunc(raw, func(r rune) bool { return r == '\n' || r == ';' }) {
+        name, value, ok := strings.Cut(entry, ":")
+        name = strings.TrimSpace(name)
+        if !ok || name == "" {
+            slog.Warn("invalid header entry, ignoring", "env", fmt.Sprintf("BACKEND_HEADERS_%d", n))
+            continue
+        }
+        headers.Add(name, strings.TrimSpace(value))
+    }
+    return headers
+}
+
+// parseProbeMethod accepts GET or HEAD in any case. An empty value returns
+// "" so callers can tell "not set" apart; anything else is logged and ignored.
+func parseProbeMethod(raw, source string) string {
+    method := strings.ToUpper(strings.TrimSpace(raw))
+    switch method {
+    case "", http.MethodGet, http.MethodHead:
+        return method
+    default:
+        slog.Warn("unsupported probe method, using GET", "source", source, "value", raw)
+        return ""
+    }
+}
+
+func parseTargetWeight(options map[string]string) int {
+    raw, ok := options["weight"]
+    if !ok {
+        return 1
+    }
+
+    weight, err := strconv.Atoi(raw)
+    if err != nil || weight < 0 {
+        slog.Warn("invalid backend weight, using 1", "value", raw)
+        return 1
+    }
+    return weight
+}
+
+// parseTargetNormalize reads the "normalize" option, which overrides
+// NORMALIZE_PATH for one target.
+func parseTargetNormalize(options map[string]string) bool {
+    raw, ok := options["normalize"]
+    if !ok {
+        return normalizePath
+    }
+
+    value, err := strconv.ParseBool(raw)
+    if err != nil {
+        slog.Warn("invalid backend normalize option, using NORMALIZE_PATH", "value", raw)
+        return normalizePath
+    }
+    return value
+}
+
+func parseTargetChat(options map[string]string) int64 {
+    raw, ok := options["alertchat"]
+    if !ok {
+        return 0
+    }
+
+    chatID, err := strconv.ParseInt(raw, 10, 64)
+    if err != nil {
+        slog.Warn("invalid backend alertchat, ignoring", "value", raw)
+        return 0
+    }
+    return chatID
+}
+
+// normalizeBackendTarget turns a target entry into its display string and the
+// URL to probe. Entries may be prefixed with a display name as "Name=url" or
+// "Name|url"; the "|" form is probed at exactly the path given, everything
+// else gets the health path appended unless rewrite is false, in which case
+// the path is kept verbatim. Without a name the host is displayed.
+func normalizeBackendTarget(raw string, rewrite bool) (string, string) {
+    display, input, customPath := splitTargetName(raw)
+    if input == "" {
+        return "", ""
+    }
+    if !schemePattern.MatchString(input) {
+        input = defaultScheme + "://" + input
+    }
+
+    parsed, err := url.Parse(input)
+    if err != nil {
+        return input, ""
+    }
+
+    if parsed.Host == "" {
+        parsed.Host = parsed.Path
+        parsed.Path = ""
+    }
+    if !validPort(parsed.Port()) {
+        return input, ""
+    }
+    if display == "" {
+        display = parsed.Host
+    }
+
+    switch {
+    case !rewrite:
+    case customPath && strings.Trim(parsed.Path, "/") != "":
+        parsed.Path = "/" + strings.Trim(parsed.Path, "/")
+    default:
+        parsed.Path = joinHealthPath(parsed.Path, healthPath)
+    }
+    parsed.Fragment = ""
+
+    return display, parsed.String()
+}
+
+// redactEntry hides credentials and query values in a backend entry before
+// it is reported. Entries that cannot be parsed are only echoed when they
+// carry neither.
+func redactEntry(item string) string {
+    base, _ := splitTargetOptions(item)
+    base, _ = splitTargetTag(base)
+    _, base, _ = splitTargetName(base)
+    if strings.ContainsAny(base, "@?") {
+        // Without a scheme the user info would be taken for one.
+        withScheme := base
+        if !strings.Contains(base, "://") {
+            withScheme = "//" + base
+        }
+        if _, err := url.Parse(withScheme); err != nil {
+            return "(unparseable entry)"
+        }
+        return strings.TrimPrefix(redactURL(withScheme), "//")
+    }
+    return base
+}
+
+// validPort accepts an absent port or a number from 1 to 65535. url.Parse
+// already rejects non-numeric ports but not out-of-range ones.
+func validPort(port string) bool {
+    if port == "" {
+        return true
+    }
+    n, err := strconv.Atoi(port)
+    return err == nil && n >= 1 && n <= 65535
+}
+
+// splitTargetName separates an optional display name from a target entry.
+// "=" only counts as a separator when the part before it cannot be part of a
+// URL, so query strings are left alone.
+func splitTargetName(raw string) (string, string, bool) {
+    trimmed := strings.TrimSpace(raw)
+    if name, rest, ok := strings.Cut(trimmed, "|"); ok {
+        return strings.TrimSpace(name), strings.TrimSpace(rest), true
+    }
+    if name, rest, ok := strings.Cut(trimmed, "="); ok && !strings.ContainsAny(name, "/:?") {
+        return strings.TrimSpace(name), strings.TrimSpace(rest), false
+    }
+    return "", trimmed, false
+}
+
+// joinHealthPath appends the health path to a base path without producing
+// doubled slashes or repeating a health path that is already present.
+func joinHealthPath(base, health string) string {
+    base = strings.TrimSuffix(base, "/")
+    health = strings.Trim(health, "/")
+    if health == "" {
+        if base == "" {
+            return "/"
+        }
+        return base
+    }
+    if strings.HasSuffix(base, "/"+health) {
+        return base
+    }
+    return base + "/" + health
+}
+
+// knownUpdateTypes are the update types ALLOWED_UPDATES may list.
+var knownUpdateTypes = map[string]bool{
+    "message":              true,
+    "edited_message":       true,
+    "channel_post":         true,
+    "edited_channel_post":  true,
+    "callback_query":       true,
+    "inline_query":         true,
+    "chosen_inline_result": true,
+    "my_chat_member":       true,
+    "chat_member":          true,
+    "chat_join_request":    true,
+}
+
+// loadAllowedUpdates reads the update types requested from getUpdates.
+// Unknown names are dropped; an unset or empty list keeps the default.
+func loadAllowedUpdates() []string {
+    raw := strings.TrimSpace(os.Getenv("ALLOWED_UPDATES"))
+    if raw == "" {
+        return allowedUpdates
+    }
+
+    var types []string
+    for _, item := range parseBackendList(raw) {
+        name := strings.ToLower(item)
+        if !knownUpdateTypes[name] {
+            slog.Warn("unknown update type in ALLOWED_UPDATES, ignoring", "value", item)
+            continue
+        }
+        types = append(types, name)
+    }
+    if len(types) == 0 {
+        return allowedUpdates
+    }
+    return types
+}
+
+// loadDisplayLocation returns the time zone used for timestamps shown to
+// users: DISPLAY_TZ when set, otherwise the process zone, which honours TZ.
+func loadDisplayLocation() *time.Location {
+    name := strings.TrimSpace(os.Getenv("DISPLAY_TZ"))
+    if name == "" {
+        return time.Local
+    }
+    loc, err := time.LoadLocation(name)
+    if err != nil {
+        slog.Warn("invalid DISPLAY_TZ, using local time", "value", name, "error", err)
+        return time.Local
+    }
+    return loc
+}
+
+// loadTelegramAPI reads the Bot API server from TELEGRAM_API_BASE, e.g. a
+// self-hosted telegram-bot-api, without a trailing slash.
+func loadTelegramAPI() string {
+    raw := strings.TrimRight(strings.TrimSpace(os.Getenv("TELEGRAM_API_BASE")), "/")
+    if raw == "" {
+        return defaultTelegramAPI
+    }
+    parsed, err := url.Parse(raw)
+    if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+        slog.Warn("invalid TELEGRAM_API_BASE, using the public API", "value", raw)
+        return defaultTelegramAPI
+    }
+    return raw
+}
+
+// loadDefaultScheme reads the scheme DEFAULT_SCHEME puts in front of targets
+// given without one.
+func loadDefaultScheme() string {
+    raw := strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_SCHEME")))
+    switch raw {
+    case "":
+        return "https"
+    case "http", "https":
+        return raw
+    default:
+        slog.Warn("unsupported DEFAULT_SCHEME, using https", "value", raw)
+        return "https"
+    }
+}
+
+func loadHealthPath() string {
+    value := strings.TrimSpace(os.Getenv("BACKEND_HEALTH_PATH"))
+    if value == "" {
+        return defaultHealthPath
+    }
+    return "/" + strings.Trim(value, "/")
+}
+
+func envSeconds(name string, fallback time.Duration) time.Duration {
+    raw := strings.TrimSpace(os.Getenv(name))
+    if raw == "" {
+        return fallback
+    }
+
+    value, err := strconv.Atoi(raw)
+    if err != nil || value < 0 {
+        slog.Warn("invalid value, using default", "env", name, "value", raw, "default", fallback.String())
+        return fallback
+    }
+
+    return time.Duration(value) * time.Second
+}
+
+func loadRedactPatterns() []*regexp.Regexp {
+    raw := strings.TrimSpace(os.Getenv("SNIPPET_REDACT"))
+    if raw == "" {
+        return nil
+    }
+
+    items := strings.FieldsFunc(raw, func(r rune) bool {
+        return r == ';' || r == '\n'
+    })
+
+    patterns := make([]*regexp.Regexp, 0, len(items))
+    for _, item := range items {
+        item = strings.TrimSpace(item)
+        if item == "" {
+            continue
+        }
+        pattern, err := regexp.Compile(item)
+        if err != nil {
+            slog.Warn("invalid SNIPPET_REDACT pattern", "pattern", item, "error", err)
+            continue
+        }
+        patterns = append(patterns, pattern)
+    }
+
+    return patterns
+}
+
+func envInt(name string, fallback, min, max int) int {
+    raw := strings.TrimSpace(os.Getenv(name))
+    if raw == "" {
+        return fallback
+    }
+
+    value, err := strconv.Atoi(raw)
+    if err != nil || value < min || value > max {
+        slog.Warn("invalid value, using default", "env", name, "value", raw, "default", fallback)
+        return fallback
+    }
+
+    return value
+}
+
+// envString returns the trimmed value of name, or fallback when it is unset
+// or blank.
+func envString(name, fallback string) string {
+    if raw := strings.TrimSpace(os.Getenv(name)); raw != "" {
+        return raw
+    }
+    return fallback
+}
+
+func envBool(name string, fallback bool) bool {
+    raw := strings.TrimSpace(os.Getenv(name))
+    if raw == "" {
+        return fallback
+    }
+
+    value, err := strconv.ParseBool(raw)
+    if err != nil {
+        slog.Warn("invalid value, using default", "env", name, "value", raw, "default", fallback)
+        return fallback
+    }
+
+    return value
+}
+
+func loadSortMode() string {
+    mode := strings.ToLower(strings.TrimSpace(os.Getenv("SORT_BACKENDS")))
+    switch mode {
+    case "", "none":
+        return "none"
+    case "status", "latency":
+        return mode
+    default:
+        slog.Warn("invalid SORT_BACKENDS, using none", "value", mode)
+        return "none"
+    }
+}
+
+func loadNotifiers(client doer, token string) []notifier {
+    var notifiers []notifier
+
+    // Per-backend and per-group routing may target Telegram even without a
+    // global chat, so the Telegram notifier is always registered.
+    notifiers = append(notifiers, newTelegramNotifier(client, token, loadAlertChats()))
+    if raw := strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL")); raw != "" {
+        notifiers = append(notifiers, &discordNotifier{client: client, webhookURL: raw})
+    }
+    if raw := strings.TrimSpace(os.Getenv("ALERT_WEBHOOK_URL")); raw != "" {
+        notifiers = append(notifiers, &webhookNotifier{client: client, url: raw})
+    }
+
+    return notifiers
+}
+
+// loadAlertChats reads the global alert chats from ALERT_CHAT_IDS and the
+// older single ALERT_CHAT_ID, dropping invalid and duplicate IDs.
+func loadAlertChats() []int64 {
+    var chats []int64
+    seen := map[int64]bool{}
+    for _, name := range []string{"ALERT_CHAT_IDS", "ALERT_CHAT_ID"} {
+        for _, raw := range parseBackendList(strings.TrimSpace(os.Getenv(name))) {
+            chatID, err := strconv.ParseInt(raw, 10, 64)
+            if err != nil {
+                slog.Warn("invalid alert chat ID", "env", name, "value", raw, "error", err)
+                continue
+            }
+            if !seen[chatID] {
+                seen[chatID] = true
+                chats = append(chats, chatID)
+            }
+        }
+    }
+    return chats
+}
+
+// dispatchAlert fans an alert out to every notifier, logging failures
+// without stopping delivery to the others.
+func dispatchAlert(ctx context.Context, notifiers []notifier, a alert) {
+    var wg sync.WaitGroup
+    for _, n := range notifiers {
+        wg.Add(1)
+        go func(n notifier) {
+            defer wg.Done()
+            if err := n.Notify(ctx, a); err != nil {
+                slog.Error("notify failed", "notifier", fmt.Sprintf("%T", n), "error", err)
+            }
+        }(n)
+    }
+    wg.Wait()
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+    return &circuitBreaker{threshold: threshold, cooldown: cooldown, states: map[string]*breakerState{}}
+}
+
+// allow reports whether url may be probed now. A threshold of 0 disables the
+// breaker.
+func (b *circuitBreaker) allow(url string, now time.Time) bool {
+    if b.threshold <= 0 {
+        return true
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    state, ok := b.states[url]
+    if !ok || state.failures < b.threshold {
+        return true
+    }
+    if state.trial || now.Sub(state.openedAt) < b.cooldown {
+        return false
+    }
+    state.trial = true
+    return true
+}
+
+func (b *circuitBreaker) record(url string, ok bool, now time.Time) {
+    if b.threshold <= 0 {
+        return
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if ok {
+        delete(b.states, url)
+        return
+    }
+
+    state, exists := b.states[url]
+    if !exists {
+        state = &breakerState{}
+        b.states[url] = state
+    }
+    state.failures++
+    state.trial = false
+    if state.failures >= b.threshold {
+        state.openedAt = now
+    }
+}
+
+// cancel releases a half-open trial that was granted by allow but never ran,
+// leaving the failure count untouched so the next check may try again.
+func (b *circuitBreaker) cancel(url string) {
+    if b.threshold <= 0 {
+        return
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if state, ok := b.states[url]; ok {
+        state.trial = false
+    }
+}
+
+func newAlertTracker(confirm int) *alertTracker {
+    return &alertTracker{confirm: confirm, states: map[string]*alertState{}}
+}
+
+func (t *alertTracker) observe(targets []backendTarget, results []backendResult, now time.Time) []alert {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    var alerts []alert
+    for i, target := range targets {
+        result := results[i]
+        if result.err == "cancelled" {
+            continue
+        }
+        state, known := t.states[target.url]
+        if !known {
+            t.states[target.url] = &alertState{online: result.ok}
+            continue
+        }
+        if result.ok == state.online {
+            state.streak = 0
+            continue
+        }
+
+        state.streak++
+        if state.streak < t.confirm {
+            continue
+        }
+        state.online = result.ok
+        state.streak = 0
+
+        status := "offline"
+        if result.ok {
+            status = "online"
+        }
+        alerts = append(alerts, alert{
+            Name:   target.display,
+            URL:    redactURL(target.url),
+            Online: result.ok,
+            Status: status,
+            Error:  result.err,
+            Time:   now,
+            chatID: resolveAlertChat(target, alertGroupChats),
+        })
     }
 
-    return &http.Client{Transport: transport}
+    return alerts
 }
 
-func getUpdates(client *http.Client, token string, offset int) ([]update, error) {
-    endpoint := fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates?timeout=%d&offset=%d&allowed_updates=message", token, int(pollTimeout.Seconds()), offset)
-    ctx, cancel := context.WithTimeout(context.Background(), pollTimeout+5*time.Second)
-    defer cancel()
+// formatAlertText renders an alert with ALERT_TEMPLATE, or the default text,
+// which shows the error the way the status message does. The raw error code
+// stays in alert.Error for templates and webhooks.
+func formatAlertText(a alert) string {
+    if alertTemplate != nil {
+        var buf bytes.Buffer
+        err := alertTemplate.Execute(&buf, a)
+        if err == nil {
+            return buf.String()
+        }
+        slog.Error("render ALERT_TEMPLATE failed", "error", err)
+    }
 
-    req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
-    if err != nil {
-        return nil, err
+    if a.Online {
+        return fmt.Sprintf("✅ 后端恢复: %s", a.Name)
     }
 
-    resp, err := client.Do(req)
-    if err != nil {
-        return nil, err
+    text := fmt.Sprintf("❌ 后端离线: %s", a.Name)
+    if a.Error != "" {
+        text += fmt.Sprintf("\n错误: %s", errorLabel(a.Error))
     }
-    defer resp.Body.Close()
+    return text
+}
 
-    if resp.StatusCode != http.StatusOK {
-        body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-        return nil, fmt.Errorf("getUpdates status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+// Notify sends the alert to the backend's routed chat if it has one, and
+// otherwise to every global alert chat concurrently. A failed chat does not
+// stop delivery to the others; all failures are returned together.
+func (n *telegramNotifier) Notify(ctx context.Context, a alert) error {
+    chats := n.chatIDs
+    if a.chatID != 0 {
+        chats = []int64{a.chatID}
     }
+    text := formatAlertText(a)
 
-    data, err := io.ReadAll(io.LimitReader(resp.Body, updatesBodyLimit))
-    if err != nil {
-        return nil, err
+    errs := make([]error, len(chats))
+    var wg sync.WaitGroup
+    for i, chatID := range chats {
+        wg.Add(1)
+        go func(i int, chatID int64) {
+            defer wg.Done()
+            select {
+            case n.sem <- struct{}{}:
+            case <-ctx.Done():
+                errs[i] = fmt.Errorf("chat %d: %w", chatID, ctx.Err())
+                return
+            }
+            defer func() { <-n.sem }()
+            if err := sendMessage(ctx, n.client, n.token, chatID, text); err != nil {
+                errs[i] = fmt.Errorf("chat %d: %w", chatID, err)
+            }
+        }(i, chatID)
     }
+    wg.Wait()
+    return errors.Join(errs...)
+}
 
-    var decoded updateResponse
-    if err := json.Unmarshal(data, &decoded); err != nil {
-        return nil, err
+// resolveAlertChat picks the Telegram chat for a backend's alerts: the
+// backend's own @alertchat, then its group's chat from ALERT_GROUP_CHATS.
+// Zero means the notifier's global ALERT_CHAT_IDS apply.
+func resolveAlertChat(target backendTarget, groupChats map[string]int64) int64 {
+    if target.alertChat != 0 {
+        return target.alertChat
     }
-    if !decoded.Ok {
-        return nil, errors.New("telegram api returned ok=false")
+    if target.group != "" {
+        if chatID, ok := groupChats[target.group]; ok {
+            return chatID
+        }
     }
+    return 0
+}
 
-    return decoded.Result, nil
+func (n *discordNotifier) Notify(ctx context.Context, a alert) error {
+    return postJSON(ctx, n.client, n.webhookURL, map[string]string{"content": formatAlertText(a)})
 }
 
-func sendMessage(client *http.Client, token string, chatID int64, text string) error {
-    payload := sendMessageRequest{
-        ChatID:                chatID,
-        Text:                  text,
-        DisableWebPagePreview: true,
-    }
+func (n *webhookNotifier) Notify(ctx context.Context, a alert) error {
+    return postJSON(ctx, n.client, n.url, a)
+}
+
+func postJSON(ctx context.Context, client doer, endpoint string, payload any) error {
     body, err := json.Marshal(payload)
     if err != nil {
         return err
     }
 
-    endpoint := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", token)
-    ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+    ctx, cancel := context.WithTimeout(ctx, telegramTimeout)
     defer cancel()
 
     req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
@@ -224,277 +5376,509 @@ func sendMessage(client *http.Client, token string, chatID int64, text string) e
     }
     defer resp.Body.Close()
 
-    if resp.StatusCode != http.StatusOK {
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
         respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-        return fmt.Errorf("sendMessage status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+        return fmt.Errorf("webhook status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
     }
 
     return nil
 }
 
-func isBackendCommand(text string) bool {
-    trimmed := strings.TrimSpace(text)
-    return trimmed == "/backend" || trimmed == "/后端状态" || trimmed == "后端状态"
+func newMetrics() *metrics {
+    return &metrics{
+        commands:       map[string]uint64{},
+        probes:         map[string]uint64{},
+        latencyBuckets: make([]uint64, len(latencyBounds)),
+    }
 }
 
-func buildStatusMessage(client *http.Client) string {
-	targets, truncated := loadBackendTargets()
-	if len(targets) == 0 {
-		return "未配置后端地址，请设置 BACKEND_URLS 环境变量。"
-	}
-
-    results := checkBackends(client, targets)
-    blocks := make([]string, 0, len(results))
-	onlineCount := 0
+func (m *metrics) recordCommand(name string) {
+    m.mu.Lock()
+    m.commands[name]++
+    m.mu.Unlock()
+}
 
-	for i, result := range results {
-		if result.ok {
-			onlineCount++
+func (m *metrics) recordProbe(result backendResult) {
+    label := "ok"
+    if !result.ok {
+        label = result.err
+        if strings.HasPrefix(label, "HTTP ") {
+            label = "http_error"
         }
-        blocks = append(blocks, formatBackendBlock(i+1, targets[i].display, result))
     }
 
-	offlineCount := len(results) - onlineCount
-	title := fmt.Sprintf("后端状态 (%d) 在线 %d / 离线 %d", len(results), onlineCount, offlineCount)
-	if truncated {
-		title += fmt.Sprintf(" - 仅显示前 %d 个", maxBackends)
-	}
+    m.mu.Lock()
+    defer m.mu.Unlock()
 
-	return title + "\n\n" + strings.Join(blocks, "\n\n")
+    m.probes[label]++
+    if result.latency > 0 {
+        seconds := result.latency.Seconds()
+        for i, bound := range latencyBounds {
+            if seconds <= bound {
+                m.latencyBuckets[i]++
+            }
+        }
+        m.latencySum += seconds
+        m.latencyCount++
+    }
 }
 
-func checkBackends(client *http.Client, targets []backendTarget) []backendResult {
-    results := make([]backendResult, len(targets))
-    sem := make(chan struct{}, maxConcurrency)
-    var wg sync.WaitGroup
-
-    for i, target := range targets {
-        wg.Add(1)
-        go func(idx int, url string) {
-            defer wg.Done()
-            sem <- struct{}{}
-            results[idx] = fetchBackendInfo(client, url)
-            <-sem
-        }(i, target.url)
+func (m *metrics) recordCheck(results []backendResult) {
+    online := 0
+    for _, result := range results {
+        if result.ok {
+            online++
+        }
     }
 
-    wg.Wait()
-    return results
+    m.mu.Lock()
+    m.onlineBackends = online
+    m.totalBackends = len(results)
+    m.mu.Unlock()
 }
 
-func fetchBackendInfo(client *http.Client, targetURL string) backendResult {
-    ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-    defer cancel()
+func (m *metrics) writeTo(w io.Writer) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
 
-    req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
-    if err != nil {
-        return backendResult{ok: false, err: "request_error"}
+    fmt.Fprintln(w, "# HELP tgbot_commands_total Commands served, by command.")
+    fmt.Fprintln(w, "# TYPE tgbot_commands_total counter")
+    for _, name := range sortedKeys(m.commands) {
+        fmt.Fprintf(w, "tgbot_commands_total{command=%q} %d\n", name, m.commands[name])
     }
-    req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-    req.Header.Set("Accept", "text/plain,text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
 
-    resp, err := client.Do(req)
-    if err != nil {
-        return backendResult{ok: false, err: classifyError(err)}
+    fmt.Fprintln(w, "# HELP tgbot_backend_probes_total Backend probes, by result.")
+    fmt.Fprintln(w, "# TYPE tgbot_backend_probes_total counter")
+    for _, name := range sortedKeys(m.probes) {
+        fmt.Fprintf(w, "tgbot_backend_probes_total{result=%q} %d\n", name, m.probes[name])
     }
-    defer resp.Body.Close()
 
-    body, err := io.ReadAll(io.LimitReader(resp.Body, backendBodyLimit))
-    if err != nil {
-        return backendResult{ok: false, err: "read_error"}
+    fmt.Fprintln(w, "# HELP tgbot_backend_latency_seconds Backend probe latency.")
+    fmt.Fprintln(w, "# TYPE tgbot_backend_latency_seconds histogram")
+    for i, bound := range latencyBounds {
+        fmt.Fprintf(w, "tgbot_backend_latency_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'f', -1, 64), m.latencyBuckets[i])
     }
+    fmt.Fprintf(w, "tgbot_backend_latency_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyCount)
+    fmt.Fprintf(w, "tgbot_backend_latency_seconds_sum %s\n", strconv.FormatFloat(m.latencySum, 'f', -1, 64))
+    fmt.Fprintf(w, "tgbot_backend_latency_seconds_count %d\n", m.latencyCount)
 
-    if resp.StatusCode != http.StatusOK {
-        return backendResult{ok: false, status: resp.StatusCode, err: fmt.Sprintf("HTTP %d", resp.StatusCode)}
+    fmt.Fprintln(w, "# HELP tgbot_backends_online Online backends in the most recent check.")
+    fmt.Fprintln(w, "# TYPE tgbot_backends_online gauge")
+    fmt.Fprintf(w, "tgbot_backends_online %d\n", m.onlineBackends)
+    fmt.Fprintln(w, "# HELP tgbot_backends_total Backends in the most recent check.")
+    fmt.Fprintln(w, "# TYPE tgbot_backends_total gauge")
+    fmt.Fprintf(w, "tgbot_backends_total %d\n", m.totalBackends)
+}
+
+func sortedKeys(values map[string]uint64) []string {
+    keys := make([]string, 0, len(values))
+    for key := range values {
+        keys = append(keys, key)
     }
+    sort.Strings(keys)
+    return keys
+}
 
-    text := strings.TrimSpace(string(body))
-    typ, info := detectBackend(text)
+// serveHealth answers /healthz while the poller keeps cycling and /readyz
+// once the first getUpdates call has succeeded.
+func serveHealth(ctx context.Context, listen string, wd *watchdog) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+        if !wd.alive(time.Now()) {
+            http.Error(w, "poller stalled", http.StatusServiceUnavailable)
+            return
+        }
+        io.WriteString(w, "ok\n")
+    })
+    mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+        if !pollReady.Load() {
+            http.Error(w, "not ready", http.StatusServiceUnavailable)
+            return
+        }
+        io.WriteString(w, "ok\n")
+    })
 
-    return backendResult{ok: true, status: resp.StatusCode, typ: typ, info: info}
-}
+    server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        server.Shutdown(shutdownCtx)
+    }()
 
-func classifyError(err error) string {
-    if errors.Is(err, context.DeadlineExceeded) {
-        return "timeout"
+    slog.Info("health server listening", "addr", listen)
+    if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+        slog.Error("health server failed", "error", err)
     }
+}
 
-    var netErr net.Error
-    if errors.As(err, &netErr) && netErr.Timeout() {
-        return "timeout"
-    }
+func serveMetrics(ctx context.Context, listen string) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        botMetrics.writeTo(w)
+    })
 
-    return "connection_error"
-}
+    server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        server.Shutdown(shutdownCtx)
+    }()
 
-func detectBackend(text string) (string, backendInfo) {
-    if info, ok := parseExtendedInfo(text); ok {
-        return "SubConverter-Extended", info
+    slog.Info("metrics listening", "addr", listen)
+    if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+        slog.Error("metrics server failed", "error", err)
     }
+}
 
-    trimmed := strings.TrimSpace(text)
-    if versionPattern.MatchString(trimmed) || strings.Contains(strings.ToLower(trimmed), "subconverter") {
-        return "subconverter", backendInfo{version: trimmed}
+func envIDSet(name string) map[int64]struct{} {
+    ids := map[int64]struct{}{}
+    for _, item := range parseBackendList(strings.TrimSpace(os.Getenv(name))) {
+        id, err := strconv.ParseInt(item, 10, 64)
+        if err != nil {
+            slog.Warn("invalid id", "env", name, "value", item)
+            continue
+        }
+        ids[id] = struct{}{}
     }
-
-    return "unknown", backendInfo{snippet: compactSnippet(trimmed, 200)}
+    return ids
 }
 
-func parseExtendedInfo(text string) (backendInfo, bool) {
-    if !extendedMarker.MatchString(text) {
-        return backendInfo{}, false
+func loadSendTokens(primary string) *tokenRotator {
+    extra := parseBackendList(strings.TrimSpace(os.Getenv("SEND_TOKENS")))
+    if len(extra) == 0 {
+        return nil
     }
 
-    matches := infoCardPattern.FindAllStringSubmatch(text, -1)
-    if len(matches) == 0 {
-        return backendInfo{}, false
+    tokens := []string{primary}
+    seen := map[string]bool{primary: true}
+    for _, token := range extra {
+        if !seen[token] {
+            seen[token] = true
+            tokens = append(tokens, token)
+        }
     }
+    return newTokenRotator(tokens)
+}
 
-    info := backendInfo{}
-    for _, match := range matches {
-        label := strings.ToLower(strings.TrimSpace(match[1]))
-        value := stripHTML(match[2])
+func newMarkdownEscaper() *strings.Replacer {
+    const reserved = "\\_*[]()~`>#+-=|{}.!"
+    pairs := make([]string, 0, len(reserved)*2)
+    for _, r := range reserved {
+        pairs = append(pairs, string(r), "\\"+string(r))
+    }
+    return strings.NewReplacer(pairs...)
+}
 
-        switch label {
-        case "version":
-            info.version = value
-        case "build":
-            info.build = value
-        case "build date":
-            info.buildDate = value
+// stripMarkdownV2 renders MarkdownV2 as the plain text Telegram would show,
+// for text that leaves Telegram's formatting such as a document upload.
+// Escapes are resolved, emphasis markers and code fences dropped, and links
+// written as "text (url)".
+func stripMarkdownV2(text string) string {
+    runes := []rune(text)
+    out := make([]rune, 0, len(runes))
+    inCode, inPre := false, false
+    for i := 0; i < len(runes); i++ {
+        r := runes[i]
+        switch {
+        case r == '\\' && i+1 < len(runes):
+            i++
+            out = append(out, runes[i])
+        case r == '`' && i+2 < len(runes) && runes[i+1] == '`' && runes[i+2] == '`':
+            i += 2
+            if inPre {
+                if n := len(out); n > 0 && out[n-1] == '\n' {
+                    out = out[:n-1]
+                }
+            } else {
+                // A single word on the rest of the opening line names the
+                // language; it and the line break are not part of the code.
+                end := i + 1
+                for end < len(runes) && runes[end] != '\n' && runes[end] != ' ' && runes[end] != '`' {
+                    end++
+                }
+                if end < len(runes) && runes[end] == '\n' {
+                    i = end
+                }
+            }
+            inPre = !inPre
+        case r == '`' && !inPre:
+            inCode = !inCode
+        case inCode || inPre:
+            out = append(out, r)
+        case r == '*' || r == '_' || r == '~' || r == '[':
+        case r == '|' && i+1 < len(runes) && runes[i+1] == '|':
+            i++
+        case r == ']' && i+1 < len(runes) && runes[i+1] == '(':
+            out = append(out, ' ', '(')
+            for i += 2; i < len(runes) && runes[i] != ')'; i++ {
+                if runes[i] == '\\' && i+1 < len(runes) {
+                    i++
+                }
+                out = append(out, runes[i])
+            }
+            out = append(out, ')')
+        case r == ']':
+        default:
+            out = append(out, r)
         }
     }
+    return string(out)
+}
 
-    if info.version == "" && info.build == "" && info.buildDate == "" {
-        return backendInfo{}, false
+func loadParseMode() string {
+    raw := strings.TrimSpace(os.Getenv("PARSE_MODE"))
+    switch strings.ToLower(raw) {
+    case "":
+        return ""
+    case "markdownv2":
+        return markdownV2
+    default:
+        slog.Warn("unsupported PARSE_MODE, using plain text", "value", raw)
+        return ""
     }
-
-    return info, true
 }
 
-func stripHTML(value string) string {
-    return strings.TrimSpace(tagPattern.ReplaceAllString(value, ""))
+func newSnapshot(targets []backendTarget, results []backendResult, now time.Time) snapshot {
+    entries := make([]snapshotEntry, 0, len(results))
+    for i, result := range results {
+        entries = append(entries, snapshotEntry{
+            Display:   targets[i].display,
+            URL:       redactURL(targets[i].url),
+            Online:    result.ok,
+            Status:    result.status,
+            Error:     result.err,
+            Type:      result.typ,
+            Version:   result.info.version,
+            LatencyMs: result.latency.Milliseconds(),
+        })
+    }
+    return snapshot{Time: now.UTC(), Results: entries}
 }
 
-func compactSnippet(text string, limit int) string {
-    text = whitespacePattern.ReplaceAllString(text, " ")
-    if len(text) > limit {
-        return text[:limit] + "..."
+// writeSnapshot stores one timestamped snapshot and prunes the directory down
+// to the newest keep files.
+func writeSnapshot(dir string, keep int, targets []backendTarget, results []backendResult, now time.Time) error {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return err
     }
-    return text
-}
 
-func formatBackendBlock(index int, display string, result backendResult) string {
-	lines := []string{fmt.Sprintf("[%d] %s", index, display)}
+    data, err := json.MarshalIndent(newSnapshot(targets, results, now), "", "  ")
+    if err != nil {
+        return err
+    }
+    name := snapshotPrefix + now.UTC().Format("20060102T150405.000Z") + ".json"
+    if err := writeFileAtomic(filepath.Join(dir, name), data); err != nil {
+        return err
+    }
 
-	if !result.ok {
-		lines = append(lines, "类型: 未知")
-		lines = append(lines, "状态: 离线")
-		if result.err != "" {
-			lines = append(lines, fmt.Sprintf("错误: %s", result.err))
-		}
-		return strings.Join(lines, "\n")
-	}
+    return pruneSnapshots(dir, keep)
+}
 
-	lines = append(lines, fmt.Sprintf("类型: %s", result.typ))
-	lines = append(lines, "状态: 在线")
+func pruneSnapshots(dir string, keep int) error {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return err
+    }
 
-	if result.typ == "SubConverter-Extended" {
-		if result.info.version != "" {
-			lines = append(lines, fmt.Sprintf("版本: %s", result.info.version))
-		}
-		if result.info.build != "" {
-			lines = append(lines, fmt.Sprintf("构建: %s", result.info.build))
-		}
-		if result.info.buildDate != "" {
-			lines = append(lines, fmt.Sprintf("构建日期: %s", result.info.buildDate))
-		}
-	} else if result.typ == "subconverter" {
-		if result.info.version != "" {
-			lines = append(lines, fmt.Sprintf("版本: %s", result.info.version))
-		}
-	} else if result.info.snippet != "" {
-		lines = append(lines, fmt.Sprintf("内容: %s", result.info.snippet))
-	}
+    var names []string
+    for _, entry := range entries {
+        name := entry.Name()
+        if entry.Type().IsRegular() && strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, ".json") {
+            names = append(names, name)
+        }
+    }
+    if len(names) <= keep {
+        return nil
+    }
 
-	return strings.Join(lines, "\n")
+    sort.Strings(names)
+    for _, name := range names[:len(names)-keep] {
+        if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+            return err
+        }
+    }
+    return nil
 }
 
-func loadBackendTargets() ([]backendTarget, bool) {
-    raw := strings.TrimSpace(os.Getenv("BACKEND_URLS"))
-    if raw == "" {
-        raw = strings.TrimSpace(os.Getenv("BACKEND_URL"))
+// loadStatsStore reads path, starting fresh when it is missing or corrupt.
+func loadStatsStore(path string) *statsStore {
+    store := &statsStore{path: path, data: statsFile{Since: time.Now(), Targets: map[string]*statsEntry{}}}
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if !errors.Is(err, os.ErrNotExist) {
+            slog.Warn("read stats file failed, starting fresh", "path", path, "error", err)
+        }
+        return store
     }
-    if raw == "" {
-        raw = defaultBackend
+    var loaded statsFile
+    if err := json.Unmarshal(data, &loaded); err != nil || loaded.Targets == nil {
+        slog.Warn("stats file is corrupt, starting fresh", "path", path, "error", err)
+        return store
     }
+    store.data = loaded
+    return store
+}
 
-    items := parseBackendList(raw)
-    truncated := len(items) > maxBackends
-    if len(items) > maxBackends {
-        items = items[:maxBackends]
-    }
+func (s *statsStore) record(targets []backendTarget, results []backendResult) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
 
-    targets := make([]backendTarget, 0, len(items))
-    for _, item := range items {
-        display, urlValue := normalizeBackendTarget(item)
-        if display == "" || urlValue == "" {
+    for i, target := range targets {
+        if results[i].err == "cancelled" {
             continue
         }
-        targets = append(targets, backendTarget{display: display, url: urlValue})
+        entry, ok := s.data.Targets[target.url]
+        if !ok {
+            entry = &statsEntry{}
+            s.data.Targets[target.url] = entry
+        }
+        entry.Checks++
+        if !results[i].ok {
+            entry.Failures++
+        }
     }
-
-    return targets, truncated
+    s.dirty = true
 }
 
-func parseBackendList(value string) []string {
-    if value == "" {
-        return nil
+// snapshot returns the start of the recorded window and a copy of the
+// counters for each of targets, zero for targets never recorded.
+func (s *statsStore) snapshot(targets []backendTarget) (time.Time, []statsEntry) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    entries := make([]statsEntry, len(targets))
+    for i, target := range targets {
+        if entry, ok := s.data.Targets[target.url]; ok {
+            entries[i] = *entry
+        }
     }
+    return s.data.Since, entries
+}
 
-    return strings.FieldsFunc(value, func(r rune) bool {
-        switch r {
-        case ',', ' ', '\t', '\n', '\r':
-            return true
-        default:
-            return false
+// run flushes pending counters every statsFlushInterval until ctx ends.
+func (s *statsStore) run(ctx context.Context) {
+    ticker := time.NewTicker(statsFlushInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            s.flush()
         }
-    })
+    }
 }
 
-func normalizeBackendTarget(raw string) (string, string) {
-    trimmed := strings.TrimSpace(raw)
-    if trimmed == "" {
-        return "", ""
+func (s *statsStore) flush() {
+    s.mu.Lock()
+    if !s.dirty {
+        s.mu.Unlock()
+        return
     }
+    data, err := json.MarshalIndent(s.data, "", "  ")
+    s.dirty = false
+    s.mu.Unlock()
 
-    input := trimmed
-    if !schemePattern.MatchString(input) {
-        input = "https://" + input
+    if err == nil {
+        err = writeFileAtomic(s.path, data)
+    }
+    if err != nil {
+        slog.Error("write stats file failed", "path", s.path, "error", err)
+        s.mu.Lock()
+        s.dirty = true
+        s.mu.Unlock()
     }
+}
 
-    parsed, err := url.Parse(input)
+func (m statusMatcher) matches(code int) bool {
+    return m.codes[code] || m.classes[code/100]
+}
+
+func parseStatusMatcher(raw string) (statusMatcher, error) {
+    matcher := statusMatcher{codes: map[int]bool{}, classes: map[int]bool{}}
+    for _, item := range parseBackendList(raw) {
+        item = strings.ToLower(item)
+        if len(item) == 3 && strings.HasSuffix(item, "xx") && item[0] >= '1' && item[0] <= '5' {
+            matcher.classes[int(item[0]-'0')] = true
+            continue
+        }
+        code, err := strconv.Atoi(item)
+        if err != nil || code < 100 || code > 599 {
+            return statusMatcher{}, fmt.Errorf("invalid status %q", item)
+        }
+        matcher.codes[code] = true
+    }
+    if len(matcher.codes) == 0 && len(matcher.classes) == 0 {
+        return statusMatcher{}, errors.New("no statuses configured")
+    }
+    return matcher, nil
+}
+
+func loadSuccessStatus() statusMatcher {
+    fallback := statusMatcher{codes: map[int]bool{http.StatusOK: true}}
+    raw := strings.TrimSpace(os.Getenv("SUCCESS_STATUS_CLASS"))
+    if raw == "" {
+        return fallback
+    }
+
+    matcher, err := parseStatusMatcher(raw)
     if err != nil {
-        return trimmed, ""
+        slog.Warn("invalid SUCCESS_STATUS_CLASS, using 200", "value", raw, "error", err)
+        return fallback
     }
+    return matcher
+}
 
-    if parsed.Host == "" {
-        parsed.Host = parsed.Path
-        parsed.Path = ""
+// loadAlertTemplate parses ALERT_TEMPLATE and renders it once against a
+// sample alert so mistakes are reported at startup instead of on the first
+// outage.
+func loadAlertTemplate() *template.Template {
+    raw := os.Getenv("ALERT_TEMPLATE")
+    if strings.TrimSpace(raw) == "" {
+        return nil
     }
 
-    path := parsed.Path
-    if path == "" || path == "/" {
-        path = "/version"
-    } else if strings.TrimSuffix(path, "/") == "/version" {
-        path = "/version"
-    } else {
-        path = strings.TrimSuffix(path, "/") + "/version"
+    tmpl, err := template.New("alert").Option("missingkey=error").Parse(raw)
+    if err != nil {
+        slog.Warn("invalid ALERT_TEMPLATE, using default", "error", err)
+        return nil
+    }
+    sample := alert{Name: "example", URL: "https://example.com/version", Status: "offline", Error: "timeout", Time: time.Now()}
+    if err := tmpl.Execute(io.Discard, sample); err != nil {
+        slog.Warn("invalid ALERT_TEMPLATE, using default", "error", err)
+        return nil
     }
+    return tmpl
+}
 
-    parsed.Path = path
-    parsed.RawQuery = ""
-    parsed.Fragment = ""
+func loadLang() string {
+    lang := strings.ToLower(strings.TrimSpace(os.Getenv("BOT_LANG")))
+    if lang == "" {
+        return defaultLang
+    }
+    if _, ok := messages[lang]; !ok {
+        slog.Warn("unsupported BOT_LANG, using default", "value", lang, "default", defaultLang)
+        return defaultLang
+    }
+    return lang
+}
 
-    return trimmed, parsed.String()
+// loadGroupChats parses ALERT_GROUP_CHATS entries of the form "group:chatid".
+func loadGroupChats() map[string]int64 {
+    chats := map[string]int64{}
+    for _, item := range parseBackendList(strings.TrimSpace(os.Getenv("ALERT_GROUP_CHATS"))) {
+        group, raw, ok := strings.Cut(item, ":")
+        chatID, err := strconv.ParseInt(raw, 10, 64)
+        if !ok || group == "" || err != nil {
+            slog.Warn("invalid ALERT_GROUP_CHATS entry", "value", item)
+            continue
+        }
+        chats[group] = chatID
+    }
+    return chats
 }